@@ -0,0 +1,397 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-shiori/dom"
+	"github.com/pkg/errors"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// The names of the readable content stored in the snapshots if Shaft.Readable is set.
+const (
+	ArticleMarkdown = "article.md"
+	ArticleText     = "article.txt"
+)
+
+// minArticleLength is the minimum length of the text of an article or main element
+// for it to be taken as the content, shorter ones are often teasers.
+const minArticleLength = 140
+
+var (
+	// unlikely matches the class and id of elements that are unlikely to be content.
+	unlikely = regexp.MustCompile(`(?i)\b(ad|ads|advert|banner|breadcrumbs?|comments?|cookie|footer|menu|modal|nav|popup|promo|related|share|sharing|sidebar|social|sponsor)\b`)
+	// spaces matches the runs of whitespace collapsed in inline content.
+	spaces = regexp.MustCompile(`\s+`)
+)
+
+// article is the readable content of a webpage.
+type article struct {
+	title   string
+	byline  string
+	content *nethtml.Node
+	base    *url.URL
+}
+
+// readable extracts the title, byline and main content of the webpage, whose
+// links are resolved against base.
+func readable(page []byte, base *url.URL) (*article, error) {
+	doc, err := nethtml.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse webpage failed")
+	}
+
+	a := &article{base: base, title: articleTitle(doc), byline: articleByline(doc)}
+	dom.RemoveNodes(dom.GetAllNodesWithTag(doc, "script", "style", "noscript", "template", "iframe", "object",
+		"embed", "svg", "canvas", "form", "button", "input", "select", "textarea", "nav", "aside", "footer"), nil)
+	dom.RemoveNodes(dom.QuerySelectorAll(doc, "[class], [id]"), func(n *nethtml.Node) bool {
+		switch dom.TagName(n) {
+		case "html", "body", "article", "main":
+			return false
+		}
+		if !unlikely.MatchString(dom.ClassName(n) + " " + dom.ID(n)) {
+			return false
+		}
+		// Wrappers of the content may be named after their sidebar too.
+		return dom.QuerySelector(n, "article, main") == nil && len(dom.GetElementsByTagName(n, "p")) <= 5
+	})
+	a.content = mainContent(doc)
+
+	// The heading of the content duplicates the title.
+	if h := dom.QuerySelector(a.content, "h1, h2"); h != nil && inlineText(h) == a.title {
+		h.Parent.RemoveChild(h)
+	}
+
+	return a, nil
+}
+
+// articleTitle returns the title of the webpage, preferring the one meant for sharing.
+func articleTitle(doc *nethtml.Node) string {
+	for _, sel := range []string{`meta[property="og:title"]`, `meta[name="twitter:title"]`} {
+		if m := dom.QuerySelector(doc, sel); m != nil {
+			if t := strings.TrimSpace(dom.GetAttribute(m, "content")); t != "" {
+				return t
+			}
+		}
+	}
+	for _, tag := range []string{"title", "h1"} {
+		if n := dom.QuerySelector(doc, tag); n != nil {
+			if t := inlineText(n); t != "" {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// articleByline returns the author of the webpage.
+func articleByline(doc *nethtml.Node) string {
+	if m := dom.QuerySelector(doc, `meta[name="author"]`); m != nil {
+		if b := strings.TrimSpace(dom.GetAttribute(m, "content")); b != "" {
+			return b
+		}
+	}
+	for _, sel := range []string{`[rel="author"]`, `[itemprop="author"]`, ".byline", ".author"} {
+		if n := dom.QuerySelector(doc, sel); n != nil {
+			if b := inlineText(n); b != "" && len(b) < 100 {
+				return b
+			}
+		}
+	}
+	return ""
+}
+
+// mainContent returns the element holding the main content of the webpage, that is the
+// article or main element if any, or else the element with the most paragraphs of text.
+func mainContent(doc *nethtml.Node) *nethtml.Node {
+	for _, sel := range []string{"article", "main", `[role="main"]`} {
+		if n := dom.QuerySelector(doc, sel); n != nil && len(inlineText(n)) >= minArticleLength {
+			return n
+		}
+	}
+
+	var (
+		best   *nethtml.Node
+		scores = make(map[*nethtml.Node]float64)
+	)
+	for _, p := range dom.GetAllNodesWithTag(doc, "p", "pre", "td", "blockquote") {
+		text := inlineText(p)
+		if len(text) < 25 || p.Parent == nil {
+			continue
+		}
+		score := 1 + float64(strings.Count(text, ",")) + float64(len(text))/100
+		if score > 4 {
+			score = 4
+		}
+		scores[p.Parent] += score
+		if gp := p.Parent.Parent; gp != nil {
+			scores[gp] += score / 2
+		}
+	}
+	for n, score := range scores {
+		if best == nil || score > scores[best] {
+			best = n
+		}
+	}
+	if best == nil {
+		best = dom.QuerySelector(doc, "body")
+	}
+	return best
+}
+
+// inlineText returns the text of the node with the whitespace collapsed.
+func inlineText(n *nethtml.Node) string {
+	return strings.TrimSpace(spaces.ReplaceAllString(dom.TextContent(n), " "))
+}
+
+// markdown renders the article in Markdown.
+func (a *article) markdown() string {
+	r := &renderer{base: a.base}
+	var b strings.Builder
+	if a.title != "" {
+		fmt.Fprintf(&b, "# %s\n\n", a.title)
+	}
+	if a.byline != "" {
+		fmt.Fprintf(&b, "By %s\n\n", a.byline)
+	}
+	b.WriteString(r.render(a.content))
+	return strings.TrimSpace(b.String()) + "\n"
+}
+
+// plainText renders the article as plain text.
+func (a *article) plainText() string {
+	r := &renderer{base: a.base, plain: true}
+	var b strings.Builder
+	if a.title != "" {
+		fmt.Fprintf(&b, "%s\n", a.title)
+	}
+	if a.byline != "" {
+		fmt.Fprintf(&b, "By %s\n", a.byline)
+	}
+	if b.Len() > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString(r.render(a.content))
+	return strings.TrimSpace(b.String()) + "\n"
+}
+
+// renderer renders the content of an article in Markdown, or as plain text.
+type renderer struct {
+	base  *url.URL
+	plain bool
+}
+
+// render returns the blocks of the node separated by blank lines.
+func (r *renderer) render(n *nethtml.Node) string {
+	if n == nil {
+		return ""
+	}
+	return strings.Join(r.blocks(n), "\n\n")
+}
+
+// blocks renders the children of the node as blocks, the inline content
+// between block elements is gathered into paragraphs.
+func (r *renderer) blocks(n *nethtml.Node) []string {
+	var (
+		blocks []string
+		inline strings.Builder
+	)
+	flush := func() {
+		if text := strings.TrimSpace(spaces.ReplaceAllString(inline.String(), " ")); text != "" {
+			blocks = append(blocks, text)
+		}
+		inline.Reset()
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == nethtml.ElementNode && isBlock(c) {
+			flush()
+			if b := r.block(c); b != "" {
+				blocks = append(blocks, b)
+			}
+			continue
+		}
+		inline.WriteString(r.inline(c))
+	}
+	flush()
+	return blocks
+}
+
+func isBlock(n *nethtml.Node) bool {
+	switch dom.TagName(n) {
+	case "address", "article", "blockquote", "dd", "div", "dl", "dt", "figcaption", "figure", "h1", "h2", "h3", "h4",
+		"h5", "h6", "header", "hr", "li", "main", "ol", "p", "pre", "section", "table", "tbody", "thead", "tr", "ul":
+		return true
+	}
+	return false
+}
+
+// block renders a block element.
+func (r *renderer) block(n *nethtml.Node) string {
+	switch tag := dom.TagName(n); tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := r.inlineChildren(n)
+		if text == "" || r.plain {
+			return text
+		}
+		return strings.Repeat("#", int(tag[1]-'0')) + " " + text
+	case "hr":
+		if r.plain {
+			return ""
+		}
+		return "---"
+	case "pre":
+		text := strings.Trim(dom.TextContent(n), "\n")
+		if r.plain {
+			return text
+		}
+		return "```\n" + text + "\n```"
+	case "blockquote":
+		text := r.render(n)
+		if r.plain || text == "" {
+			return text
+		}
+		return "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	case "ul", "ol":
+		return r.list(n, tag == "ol")
+	case "tr":
+		var cells []string
+		for _, c := range dom.Children(n) {
+			cells = append(cells, r.inlineChildren(c))
+		}
+		return strings.Join(cells, " | ")
+	case "table", "tbody", "thead":
+		var rows []string
+		for _, c := range dom.Children(n) {
+			if row := r.block(c); row != "" {
+				rows = append(rows, row)
+			}
+		}
+		return strings.Join(rows, "\n")
+	default:
+		return r.render(n)
+	}
+}
+
+// list renders the items of a list, indenting their nested blocks.
+func (r *renderer) list(n *nethtml.Node, ordered bool) string {
+	var items []string
+	for _, li := range dom.Children(n) {
+		if dom.TagName(li) != "li" {
+			continue
+		}
+		marker := "- "
+		if ordered {
+			marker = fmt.Sprintf("%d. ", len(items)+1)
+		}
+		text := strings.Join(r.blocks(li), "\n")
+		if text == "" {
+			continue
+		}
+		items = append(items, marker+strings.ReplaceAll(text, "\n", "\n"+strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+// inlineChildren renders the children of the node as inline content.
+func (r *renderer) inlineChildren(n *nethtml.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(r.inline(c))
+	}
+	return strings.TrimSpace(spaces.ReplaceAllString(b.String(), " "))
+}
+
+// inline renders an inline node.
+func (r *renderer) inline(n *nethtml.Node) string {
+	switch n.Type {
+	case nethtml.TextNode:
+		return n.Data
+	case nethtml.ElementNode:
+	default:
+		return ""
+	}
+
+	switch dom.TagName(n) {
+	case "br":
+		return "\n"
+	case "img":
+		src := r.resolve(dom.GetAttribute(n, "src"))
+		if r.plain || src == "" {
+			return ""
+		}
+		return fmt.Sprintf("![%s](%s)", dom.GetAttribute(n, "alt"), src)
+	case "a":
+		text := r.inlineChildren(n)
+		href := r.resolve(dom.GetAttribute(n, "href"))
+		if r.plain || text == "" || href == "" {
+			return text
+		}
+		return fmt.Sprintf("[%s](%s)", text, href)
+	case "strong", "b":
+		return r.wrap(n, "**")
+	case "em", "i":
+		return r.wrap(n, "_")
+	case "code":
+		return r.wrap(n, "`")
+	default:
+		return r.inlineChildren(n)
+	}
+}
+
+// wrap renders the inline content of the node between the given markup.
+func (r *renderer) wrap(n *nethtml.Node, markup string) string {
+	text := r.inlineChildren(n)
+	if r.plain || text == "" {
+		return text
+	}
+	return markup + text + markup
+}
+
+// resolve returns the absolute URL of the reference, or empty if it is inlined
+// data, such as the resources inlined by obelisk, or a script.
+func (r *renderer) resolve(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if r.base != nil {
+		u = r.base.ResolveReference(u)
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto", "":
+		return u.String()
+	}
+	return ""
+}
+
+// text renders the content of the article as plain text, without title nor byline.
+func (a *article) text() string {
+	return (&renderer{base: a.base, plain: true}).render(a.content)
+}
+
+// writeArticle stores the article into the snapshot directory dir as ArticleMarkdown and ArticleText.
+func writeArticle(dir string, a *article) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, ArticleMarkdown), []byte(a.markdown()), 0600); err != nil {
+		return errors.Wrap(err, "create article failed")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ArticleText), []byte(a.plainText()), 0600); err != nil {
+		return errors.Wrap(err, "create article failed")
+	}
+	return nil
+}
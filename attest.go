@@ -0,0 +1,260 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"github.com/wabarc/rivet/ipfs"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+// AttestationFile is the name of the attestation stored in the snapshots if
+// Shaft.SigningKey is set.
+const AttestationFile = "manifest.sig"
+
+// Attestation is a signed statement that a snapshot of the URL was captured
+// at the given time, identifying its manifest and content. Only the attestations
+// of fetched webpages tell what was served at the URL, see Source.
+type Attestation struct {
+	URL      string    `json:"url"`
+	Captured time.Time `json:"captured"`
+
+	// Source is how the webpage was obtained, either SourceFetched or SourceSubmitted.
+	// The content of a submitted webpage is whatever its submitter wrote.
+	Source string `json:"source"`
+
+	// Manifest is the hex-encoded SHA-256 digest of the manifest file,
+	// which holds the digest and content-id of every file.
+	Manifest string `json:"manifest_sha256"`
+	// Digest identifies the content of the snapshot, see Manifest.Digest.
+	Digest string `json:"digest"`
+	// CID is the content-id of the snapshot directory without the
+	// attestation, as computed by `ipfs add -r`, that is a CIDv0.
+	CID string `json:"cid"`
+
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Signature []byte            `json:"signature,omitempty"`
+}
+
+// payload returns the signed content of the attestation, which is its JSON encoding without signature.
+func (a *Attestation) payload() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+// attest signs the manifest of the snapshot directory dir and stores the attestation in it.
+func attest(dir string, m *Manifest, key ed25519.PrivateKey) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return errors.Wrap(err, "read manifest failed")
+	}
+	root, err := unixfs.AddDir(dir, nil)
+	if err != nil {
+		return errors.Wrap(err, "compute cid failed")
+	}
+
+	sum := sha256.Sum256(b)
+	a := &Attestation{
+		URL:       m.URL,
+		Captured:  m.Captured,
+		Source:    m.Source,
+		Manifest:  hex.EncodeToString(sum[:]),
+		Digest:    m.Digest(),
+		CID:       root.Cid.String(),
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+	payload, err := a.payload()
+	if err != nil {
+		return err
+	}
+	a.Signature = ed25519.Sign(key, payload)
+
+	if b, err = json.MarshalIndent(a, "", "  "); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, AttestationFile), b, 0600); err != nil {
+		return errors.Wrap(err, "create attestation failed")
+	}
+	return nil
+}
+
+// VerifyAttestation verifies the snapshot with the given content-id as Verify does, and checks
+// that its attestation is signed by key and matches its manifest. The content-id is checked
+// as well, either as CIDv0 or CIDv1, unless the snapshot has been added with other settings
+// than the defaults of `ipfs add -r`, e.g. raw leaves. It fails if the attestation is missing,
+// forged or does not match, while the files that differ from the manifest are reported by the
+// verification. It also fails if the attestation does not record its source, the caller should
+// check that it is SourceFetched before taking it as evidence of the content served at the URL.
+//
+// The attestation of an encrypted snapshot is sealed inside the EncryptedFile, so that it
+// does not disclose the URL, and is verified once the snapshot is decrypted, see Decrypt.
+func VerifyAttestation(ctx context.Context, f ipfs.Fetcher, root string, key ed25519.PublicKey) (*Attestation, *Verification, error) {
+	v, err := Verify(ctx, f, root, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signed, manifest *ipfs.Entry
+	for i, e := range v.Files {
+		switch e.Path {
+		case AttestationFile:
+			signed = &v.Files[i]
+		case ManifestFile:
+			manifest = &v.Files[i]
+		}
+	}
+	if signed == nil || signed.SHA256 == "" {
+		for _, e := range v.Files {
+			if e.Path == EncryptedFile {
+				return nil, v, errors.New("snapshot is encrypted, its attestation is verified once decrypted")
+			}
+		}
+		return nil, v, errors.New("attestation is missing")
+	}
+	if manifest == nil || manifest.SHA256 == "" {
+		return nil, v, errors.New("manifest is missing")
+	}
+
+	var buf bytes.Buffer
+	if err := ipfs.Cat(ctx, f, signed.CID, &buf); err != nil {
+		return nil, v, err
+	}
+	var a Attestation
+	if err := json.Unmarshal(buf.Bytes(), &a); err != nil {
+		return nil, v, errors.Wrap(err, "parse attestation failed")
+	}
+	payload, err := a.payload()
+	if err != nil {
+		return nil, v, err
+	}
+
+	switch {
+	case !key.Equal(a.PublicKey):
+		return &a, v, errors.New("attestation is signed by another key")
+	case !ed25519.Verify(key, payload, a.Signature):
+		return &a, v, errors.New("attestation signature is invalid")
+	case a.Manifest != manifest.SHA256:
+		return &a, v, errors.New("attestation does not match the manifest")
+	case a.Source != SourceFetched && a.Source != SourceSubmitted:
+		return &a, v, errors.Errorf("attestation has an unknown source: %q", a.Source)
+	case v.Manifest.URL != a.URL || !v.Manifest.Captured.Equal(a.Captured) || v.Manifest.Digest() != a.Digest || v.Manifest.Source != a.Source:
+		return &a, v, errors.New("attestation does not match the snapshot")
+	}
+
+	if c, err := contentID(ctx, f, root); err != nil {
+		return &a, v, err
+	} else if c != "" && c != a.CID {
+		return &a, v, errors.Errorf("attestation does not match the cid: %s, want %s", c, a.CID)
+	}
+
+	return &a, v, nil
+}
+
+// contentID computes the CIDv0 of the snapshot directory without the attestation, it
+// returns empty if it cannot be computed the way `ipfs add -r` does by default. The root
+// may be given as CIDv1, which has the same multihash as the CIDv0 of the same block.
+func contentID(ctx context.Context, f ipfs.Fetcher, root string) (string, error) {
+	c, err := cid.Decode(root)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid cid")
+	}
+	if c.Type() != cid.DagProtobuf || c.Prefix().MhType != multihash.SHA2_256 {
+		return "", nil
+	}
+
+	b, err := f.Block(ctx, root)
+	if err != nil {
+		return "", err
+	}
+	n, err := unixfs.Decode(b)
+	if err != nil {
+		return "", err
+	}
+	links := n.Links[:0:0]
+	for _, l := range n.Links {
+		// The files have been added with other settings, e.g. CIDv1 and raw leaves.
+		if l.Cid.Version() != 0 {
+			return "", nil
+		}
+		if l.Name != AttestationFile {
+			links = append(links, l)
+		}
+	}
+	n.Links = links
+
+	sum, err := cid.V0Builder{}.Sum(n.Encode())
+	if err != nil {
+		return "", err
+	}
+	return sum.String(), nil
+}
+
+// LoadSigningKey reads the ed25519 private key from a PEM file in PKCS #8 form,
+// e.g. generated by `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key failed")
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not ed25519")
+	}
+	return k, nil
+}
+
+// LoadPublicKey reads the ed25519 public key from a PEM file in PKIX form,
+// e.g. generated by `openssl pkey -pubout`.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key failed")
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not ed25519")
+	}
+	return k, nil
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.Errorf("no %s found in %s", typ, path)
+		}
+		if block.Type == typ {
+			return block.Bytes, nil
+		}
+	}
+}
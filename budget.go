@@ -0,0 +1,166 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTooLarge is returned when a capture downloads more than Shaft.MaxCaptureSize.
+var ErrTooLarge = errors.New("capture too large")
+
+// budget counts the bytes downloaded by a capture against MaxCaptureSize, and the bytes
+// downloaded and written into WorkDir against the DiskBudget shared by the in-flight
+// captures. The nil budget has no limit.
+type budget struct {
+	max  int64 // zero means no limit
+	used atomic.Int64
+
+	diskMax int64
+	disk    *atomic.Int64 // bytes held by the in-flight captures, nil means no limit
+	held    atomic.Int64  // bytes of the capture counted in disk
+
+	mu  sync.Mutex
+	err error // set once exceeded
+}
+
+type ctxKeyBudget struct{}
+
+// withBudget returns a copy of ctx carrying the budget of a capture, unless it has no limit.
+func (s *Shaft) withBudget(ctx context.Context) context.Context {
+	if s.MaxCaptureSize <= 0 && s.DiskBudget <= 0 {
+		return ctx
+	}
+	b := &budget{max: s.MaxCaptureSize}
+	if s.DiskBudget > 0 {
+		b.diskMax, b.disk = s.DiskBudget, &s.diskUsed
+	}
+	return context.WithValue(ctx, ctxKeyBudget{}, b)
+}
+
+func budgetFrom(ctx context.Context) *budget {
+	b, _ := ctx.Value(ctxKeyBudget{}).(*budget)
+	return b
+}
+
+// spend counts n more bytes, and returns an error wrapping ErrTooLarge or ErrNoSpace
+// once they exceed the budget.
+func (b *budget) spend(n int64) error {
+	if b.max > 0 && b.used.Add(n) > b.max {
+		return b.fail(b.tooLarge())
+	}
+	return b.hold(n)
+}
+
+// hold counts n more bytes against the disk budget only, and returns an error wrapping
+// ErrNoSpace once they exceed it.
+func (b *budget) hold(n int64) error {
+	if b == nil || b.disk == nil {
+		return nil
+	}
+	b.held.Add(n)
+	if b.disk.Add(n) > b.diskMax {
+		return b.fail(errors.Wrapf(ErrNoSpace, "exceeds the disk budget of %d bytes", b.diskMax))
+	}
+	return nil
+}
+
+// release returns the bytes of the capture to the disk budget, once its directory is removed.
+func (b *budget) release() {
+	if b != nil && b.disk != nil {
+		b.disk.Add(-b.held.Swap(0))
+	}
+}
+
+// fail records err unless the budget has been exceeded already, and returns the error recorded.
+func (b *budget) fail(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	return b.err
+}
+
+// check returns the error recorded if the budget has been exceeded.
+func (b *budget) check() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *budget) tooLarge() error {
+	return errors.Wrapf(ErrTooLarge, "exceeds %d bytes", b.max)
+}
+
+// budgetTransport counts the bytes of the responses against the budget, once it is
+// exceeded the reads fail as well as every other request, so that the capture stops
+// downloading. The capture fails by the check of the budget, since obelisk skips the
+// resources that fail.
+type budgetTransport struct {
+	base   http.RoundTripper
+	budget *budget
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.budget.check(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// Fails early if the size is known, the body of HEAD responses is not.
+	if b := t.budget; b.max > 0 && req.Method != http.MethodHead && resp.ContentLength > 0 && b.used.Load()+resp.ContentLength > b.max {
+		resp.Body.Close()
+		return nil, b.fail(b.tooLarge())
+	}
+	resp.Body = &budgetBody{ReadCloser: resp.Body, budget: t.budget}
+	return resp, nil
+}
+
+// budgetBody counts the bytes read from the body against the budget.
+type budgetBody struct {
+	io.ReadCloser
+	budget *budget
+}
+
+func (b *budgetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if err := b.budget.spend(int64(n)); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// budgetWriter counts the bytes written into WorkDir against the disk budget.
+type budgetWriter struct {
+	io.Writer
+	budget *budget
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		if err := w.budget.hold(int64(n)); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
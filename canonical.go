@@ -0,0 +1,155 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-shiori/dom"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// TrackingParams are the query parameters stripped by default by Canonical,
+// a trailing * matches any suffix.
+var TrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "gclsrc", "dclid", "msclkid", "yclid", "twclid", "igshid",
+	"mc_cid", "mc_eid", "_ga", "_gl", "_hsenc", "_hsmi", "mkt_tok", "oly_anon_id", "oly_enc_id",
+	"vero_id", "wickedid", "rb_clickid", "s_cid", "ref_src",
+}
+
+// Canonical configures the canonicalization of the URLs before archiving, so that
+// the variants of a webpage are archived under the same URL, see Shaft.Canonical.
+// The scheme and host are lowercased, the default port and the fragment are dropped,
+// an empty path becomes / and the query parameters are sorted.
+type Canonical struct {
+	// Strip holds the query parameters to strip, a trailing * matches any
+	// suffix. Defaults to TrackingParams, append to it to strip more.
+	Strip []string
+
+	// HTTPS upgrades the http URLs to https.
+	HTTPS bool
+
+	// Link resolves the canonical URL declared by the webpage as <link rel="canonical">
+	// once fetched, if it is on the same site, regardless of the www subdomain.
+	Link bool
+}
+
+// URL returns the canonical form of u.
+func (c *Canonical) URL(u *url.URL) *url.URL {
+	v := *u
+	v.Scheme = strings.ToLower(v.Scheme)
+	v.Host = strings.ToLower(v.Host)
+	switch {
+	case v.Scheme == "http":
+		v.Host = strings.TrimSuffix(v.Host, ":80")
+	case v.Scheme == "https":
+		v.Host = strings.TrimSuffix(v.Host, ":443")
+	}
+	if c.HTTPS && v.Scheme == "http" {
+		v.Scheme = "https"
+	}
+	if v.Path == "" && v.Opaque == "" && v.Host != "" {
+		v.Path = "/"
+	}
+	v.Fragment, v.RawFragment = "", ""
+	v.RawQuery = c.query(v.RawQuery)
+	v.ForceQuery = false
+	return &v
+}
+
+// query strips the parameters of the raw query and sorts the others by name,
+// keeping the order of the values of a parameter and their encoding.
+func (c *Canonical) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	type param struct{ name, raw string }
+	var params []param
+	for _, p := range strings.Split(raw, "&") {
+		if p == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(p, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if !c.strip(name) {
+			params = append(params, param{name: name, raw: p})
+		}
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		return params[i].name < params[j].name
+	})
+
+	kept := make([]string, 0, len(params))
+	for _, p := range params {
+		kept = append(kept, p.raw)
+	}
+	return strings.Join(kept, "&")
+}
+
+// strip reports whether the query parameter of the given name is to be stripped.
+func (c *Canonical) strip(name string) bool {
+	patterns := c.Strip
+	if patterns == nil {
+		patterns = TrackingParams
+	}
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(name, prefix) || name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// link returns the canonical form of the canonical URL declared by the webpage
+// fetched from base, or nil if it declares none on the same site.
+func (c *Canonical) link(page []byte, base *url.URL) *url.URL {
+	doc, err := nethtml.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil
+	}
+	for _, l := range dom.QuerySelectorAll(doc, "link[rel][href]") {
+		if !strings.EqualFold(strings.TrimSpace(dom.GetAttribute(l, "rel")), "canonical") {
+			continue
+		}
+		u, err := base.Parse(strings.TrimSpace(dom.GetAttribute(l, "href")))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !sameSite(u, base) {
+			return nil
+		}
+		return c.URL(u)
+	}
+	return nil
+}
+
+// sameSite reports whether the URLs are on the same host, regardless of the www subdomain.
+func sameSite(a, b *url.URL) bool {
+	host := func(u *url.URL) string {
+		return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	}
+	return host(a) == host(b)
+}
+
+// canonicalize returns the canonical form of u if Canonical is set, or u otherwise.
+func (s *Shaft) canonicalize(u *url.URL) *url.URL {
+	if s.Canonical == nil {
+		return u
+	}
+	return s.Canonical.URL(u)
+}
+
+// original returns the URL as given if it differs from its canonical form, empty otherwise.
+func original(given, canonical *url.URL) string {
+	if given.String() == canonical.String() {
+		return ""
+	}
+	return given.String()
+}
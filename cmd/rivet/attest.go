@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/wabarc/rivet"
+	"github.com/wabarc/rivet/ipfs"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+func attest(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] cid\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] -dir directory\n")
+		os.Exit(1)
+	}
+	attestVerify(args[1:])
+}
+
+func attestVerify(args []string) {
+	var (
+		src       source
+		key       string
+		dir       string
+		submitted bool
+	)
+
+	fs := flag.NewFlagSet("attest verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] cid\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] -dir directory\n\n")
+
+		fs.PrintDefaults()
+	}
+	src.register(fs)
+	fs.StringVar(&key, "key", "", "PEM file of the ed25519 public key the attestation must be signed by")
+	fs.BoolVar(&submitted, "submitted", false, "Accept the attestations of webpages submitted to the capture rather than fetched")
+	fs.StringVar(&dir, "dir", "", "Verify the snapshot in the given directory instead, e.g. restored by rivet decrypt")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 && dir == "" {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "cid is missing")
+		os.Exit(1)
+	}
+	if key == "" {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "-key is missing")
+		os.Exit(1)
+	}
+	cid := fs.Arg(0)
+
+	pub, err := rivet.LoadPublicKey(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+	var f ipfs.Fetcher
+	if dir != "" {
+		f, cid, err = local(dir)
+	} else {
+		f, err = src.fetcher()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), src.deadline())
+	defer cancel()
+
+	a, v, err := rivet.VerifyAttestation(ctx, f, cid, pub)
+	if v != nil && !report(cid, v) {
+		err = fmt.Errorf("snapshot does not match its manifest")
+	}
+	if err == nil && a.Source == rivet.SourceSubmitted && !submitted {
+		err = fmt.Errorf("webpage was submitted rather than fetched, its content is not evidence of the URL")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		fmt.Fprintln(os.Stdout, "FAIL")
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "signed  %s %s at %s, content %s\n", a.URL, a.Source, a.Captured.Format(time.RFC3339), a.CID)
+	fmt.Fprintln(os.Stdout, "OK")
+}
+
+// blocks holds the blocks of a snapshot in memory.
+type blocks map[string][]byte
+
+func (b blocks) Block(_ context.Context, c string) ([]byte, error) {
+	if block, ok := b[c]; ok {
+		return block, nil
+	}
+	return nil, fmt.Errorf("block not found: %s", c)
+}
+
+// local adds the snapshot directory as `ipfs add -r` does, returning its blocks
+// and content-id, so that it is verified as if it was fetched from IPFS.
+func local(dir string) (ipfs.Fetcher, string, error) {
+	b := make(blocks)
+	root, err := unixfs.AddDir(dir, func(c cid.Cid, block []byte) error {
+		b[c.String()] = block
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return b, root.Cid.String(), nil
+}
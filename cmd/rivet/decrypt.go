@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"filippo.io/age"
+	"github.com/wabarc/rivet"
+)
+
+func decrypt(args []string) {
+	var (
+		src            source
+		identity       string
+		passphraseFile string
+		output         string
+	)
+
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet decrypt [options] cid\n\n")
+
+		fs.PrintDefaults()
+	}
+	src.register(fs)
+	fs.StringVar(&identity, "identity", "", "age identity file holding the private keys of the recipients")
+	fs.StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase the snapshot is encrypted with")
+	fs.StringVar(&output, "o", "", "Directory to restore the snapshot into, defaults to the cid")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "cid is missing")
+		os.Exit(1)
+	}
+	cid := fs.Arg(0)
+	if output == "" {
+		output = cid
+	}
+
+	identities, err := readIdentities(identity, passphraseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+	f, err := src.fetcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), src.deadline())
+	defer cancel()
+
+	if err := rivet.Decrypt(ctx, f, cid, identities, output); err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s  %s\n", output, cid)
+}
+
+func readIdentities(identity, passphraseFile string) ([]age.Identity, error) {
+	var identities []age.Identity
+	if identity != "" {
+		f, err := os.Open(identity)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if identities, err = age.ParseIdentities(f); err != nil {
+			return nil, err
+		}
+	}
+	if passphraseFile != "" {
+		pass, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("-identity or -passphrase-file is required")
+	}
+	return identities, nil
+}
@@ -4,33 +4,61 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/wabarc/rivet"
-	"github.com/wabarc/rivet/ipfs"
-
-	pinner "github.com/wabarc/ipfs-pinner"
 )
 
+// screen renders the progress of the URLs being archived, nil if stderr is not a terminal.
+var screen *display
+
+// commands holds the subcommands, each receives the arguments after its name.
+var commands = map[string]func(args []string){
+	"attest":  attest,
+	"decrypt": decrypt,
+	"search":  search,
+	"serve":   serve,
+	"verify":  verify,
+	"watch":   watch,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		mode    string
-		timeout uint
-		// for local mode
-		host string
-		port int
-		// for remote mode
-		target string
-		apikey string
-		secret string
+		opts  options
+		input string
+		link  string
+		crawl bool
+		scope rivet.Crawl
+		match string
+		feed  bool
+		since string
+		until string
+		jobs  int
 	)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stdout, "Usage:\n\n")
-		fmt.Fprintf(os.Stdout, "  rivet [options] [url1] ... [urlN]\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet [options] [url1] ... [urlN]\n")
+		fmt.Fprintf(os.Stdout, "  rivet [options] -input page.html -url url\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] cid\n")
+		fmt.Fprintf(os.Stdout, "  rivet attest verify [options] -dir directory\n")
+		fmt.Fprintf(os.Stdout, "  rivet decrypt [options] cid\n")
+		fmt.Fprintf(os.Stdout, "  rivet search [options] query\n")
+		fmt.Fprintf(os.Stdout, "  rivet serve [options]\n")
+		fmt.Fprintf(os.Stdout, "  rivet verify [options] cid\n")
+		fmt.Fprintf(os.Stdout, "  rivet watch [options] [url1] ... [urlN]\n\n")
 
 		flag.PrintDefaults()
 	}
@@ -40,33 +68,47 @@ func main() {
 		fmt.Fprint(os.Stdout, "\n")
 	}
 
-	flag.StringVar(&mode, "m", "remote", "Pin mode, supports mode: local, remote, archive")
-	flag.UintVar(&timeout, "timeout", 30, "Timeout for every input URL")
-	flag.StringVar(&host, "host", "localhost", "IPFS node address")
-	flag.IntVar(&port, "port", 5001, "IPFS node port")
-	flag.StringVar(&target, "t", "infura", "IPFS pinner, supports pinners: infura, pinata, nftstorage, web3storage.")
-	flag.StringVar(&apikey, "u", "", "Pinner apikey or username.")
-	flag.StringVar(&secret, "p", "", "Pinner sceret or password.")
+	opts.register(flag.CommandLine)
+	flag.StringVar(&input, "input", "", "Archive the webpage from a local HTML file instead of fetching it, use - for stdin")
+	flag.StringVar(&link, "url", "", "Original URL of the webpage given by -input")
+	flag.BoolVar(&crawl, "crawl", false, "Crawl the site of each URL and archive it as one directory")
+	flag.IntVar(&scope.Depth, "depth", 2, "Maximum number of links to follow from each URL in crawl mode")
+	flag.IntVar(&scope.Limit, "limit", 100, "Maximum number of pages to archive for each URL in crawl mode, 0 means no limit")
+	flag.StringVar(&scope.Prefix, "prefix", "", "Only follow links whose path starts with the given prefix in crawl mode")
+	flag.StringVar(&match, "match", "", "Only follow links matching the given regular expression in crawl mode, instead of the same host")
+	flag.BoolVar(&feed, "feed", false, "Treat each URL as a sitemap or RSS/Atom feed and archive the pages it lists")
+	flag.StringVar(&since, "since", "", "Only archive the pages of a feed dated on or after the given date, e.g. 2006-01-02")
+	flag.StringVar(&until, "until", "", "Only archive the pages of a feed dated on or before the given date, e.g. 2006-01-02")
+	flag.IntVar(&jobs, "parallel", 4, "Maximum number of URLs to archive at the same time")
 	flag.Parse()
 
-	opts := []ipfs.PinningOption{
-		ipfs.Mode(ipfs.Remote),
+	r, err := opts.shaft()
+	if err != nil {
+		basePrint()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(0)
 	}
-	if mode == "local" {
-		opts = []ipfs.PinningOption{
-			ipfs.Mode(ipfs.Local),
-			ipfs.Host(host),
-			ipfs.Port(port),
-		}
+
+	// The progress would garble the logs.
+	if screen = newDisplay(); screen != nil && r.Logger == nil {
+		r.Progress = screen
+	} else {
+		screen = nil
 	}
 
-	switch target {
-	case pinner.Infura, pinner.Pinata, pinner.NFTStorage, pinner.Web3Storage:
-		opts = append(opts, ipfs.Uses(target), ipfs.Apikey(apikey), ipfs.Secret(secret))
-	default:
-		basePrint()
-		fmt.Fprintln(os.Stderr, "Unknown target")
-		os.Exit(0)
+	if input != "" {
+		if link == "" || flag.NArg() > 0 {
+			basePrint()
+			fmt.Fprintln(os.Stderr, "-input requires -url and no other links")
+			os.Exit(1)
+		}
+		err := wayback(r, opts, link, input)
+		r.Wait()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	links := flag.Args()
@@ -76,31 +118,143 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
-	opt := ipfs.Options(opts...)
-	toc := time.Duration(timeout) * time.Second
-	var wg sync.WaitGroup
+	if feed {
+		if links, err = expand(r, opts, links, since, until); err != nil {
+			fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if match != "" {
+		if scope.Match, err = regexp.Compile(match); err != nil {
+			fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, jobs)
+	)
 	for _, link := range links {
 		wg.Add(1)
+		sem <- struct{}{}
 		go func(link string) {
-			defer wg.Done()
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
 
-			input, err := url.Parse(link)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
-				return
-			}
-
-			reqctx, cancel := context.WithTimeout(ctx, toc)
-			defer cancel()
-
-			r := &rivet.Shaft{Hold: opt, ArchiveOnly: mode == "archive"}
-			if dest, err := r.Wayback(reqctx, input); err != nil {
-				fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			var err error
+			if crawl {
+				err = crawlSite(r, opts, link, scope)
 			} else {
-				fmt.Fprintf(os.Stdout, "%s  %s\n", dest, link)
+				err = wayback(r, opts, link, "")
+			}
+			if err != nil {
+				screen.printf(os.Stderr, "rivet: %v\n", err)
 			}
 		}(link)
 	}
 	wg.Wait()
+	r.Wait()
+}
+
+// expand returns the URLs listed by the given sitemaps or feeds.
+func expand(r *rivet.Shaft, opts options, feeds []string, since, until string) (links []string, err error) {
+	var from, to time.Time
+	if from, err = parseDate(since); err != nil {
+		return nil, err
+	}
+	if to, err = parseDate(until); err != nil {
+		return nil, err
+	}
+	if !to.IsZero() && len(until) == len("2006-01-02") {
+		// Includes the whole day
+		to = to.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	for _, feed := range feeds {
+		source, err := url.Parse(feed)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.deadline())
+		urls, err := r.Expand(ctx, source, from, to)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range urls {
+			links = append(links, u.String())
+		}
+	}
+	return links, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// crawlSite archives the site starting from the given link and prints the destination.
+func crawlSite(r *rivet.Shaft, opts options, link string, scope rivet.Crawl) error {
+	seed, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+
+	// The timeout applies to every page, the crawl would lose all of them otherwise.
+	scope.Timeout = opts.deadline()
+	dest, err := r.Crawl(context.Background(), seed, scope)
+	if err != nil {
+		return err
+	}
+	screen.printf(os.Stdout, "%s  %s\n", dest, link)
+
+	return nil
+}
+
+// wayback archives the given link and prints the destination. If file
+// is not empty, the webpage is read from it rather than fetched.
+func wayback(r *rivet.Shaft, opts options, link, file string) error {
+	input, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.deadline())
+	defer cancel()
+
+	if file != "" {
+		page, err := readInput(file)
+		if err != nil {
+			return err
+		}
+		ctx = r.WithInput(ctx, page)
+	}
+
+	dest, err := r.Wayback(ctx, input)
+	if err != nil {
+		return err
+	}
+	screen.printf(os.Stdout, "%s  %s\n", dest, link)
+
+	return nil
+}
+
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/wabarc/rivet"
+	"github.com/wabarc/rivet/ipfs"
+
+	pinner "github.com/wabarc/ipfs-pinner"
+)
+
+// options holds the flags shared by the commands that archive webpages.
+type options struct {
+	mode    string
+	timeout uint
+	// for local mode
+	host string
+	port int
+	// for remote mode
+	target string
+	apikey string
+	secret string
+	// for all requests
+	proxy  string
+	cacert string
+	// for archive mode
+	output   string
+	template string
+	keepDir  bool
+	// for capturing
+	rules           string
+	cookies         string
+	userAgent       string
+	header          headers
+	hostConcurrency int
+	hostInterval    time.Duration
+	maxCaptureSize  int64
+	robots          bool
+	readable        bool
+	// for the work directory
+	workDir      string
+	minFreeSpace int64
+	diskBudget   int64
+	keepFailed   bool
+	// for canonicalization
+	canonical     bool
+	canonicalLink bool
+	https         bool
+	strip         list
+	// for guarding
+	guard bool
+	block list
+	allow list
+	// for search
+	index string
+	// for logging
+	logLevel  string
+	logFormat string
+	// for notifications
+	webhooks      list
+	webhookSecret string
+	deadLetter    string
+	// for attestations
+	signingKey string
+	// for encryption
+	recipients     list
+	passphraseFile string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.mode, "m", "remote", "Pin mode, supports mode: local, remote, archive")
+	fs.UintVar(&o.timeout, "timeout", 30, "Timeout for every input URL, or every page in crawl mode")
+	fs.StringVar(&o.host, "host", "localhost", "IPFS node address")
+	fs.IntVar(&o.port, "port", 5001, "IPFS node port")
+	fs.StringVar(&o.target, "t", "infura", "IPFS pinner, supports pinners: infura, pinata, nftstorage, web3storage.")
+	fs.StringVar(&o.apikey, "u", "", "Pinner apikey or username.")
+	fs.StringVar(&o.secret, "p", "", "Pinner sceret or password.")
+	fs.StringVar(&o.proxy, "proxy", "", "Proxy of the requests for capturing and pinning, e.g. http://127.0.0.1:8118 or socks5://127.0.0.1:9050")
+	fs.StringVar(&o.cacert, "cacert", "", "PEM file of the certificate authorities to trust besides the system ones")
+	fs.StringVar(&o.output, "o", "", "Output directory in archive mode, defaults to the working directory")
+	fs.StringVar(&o.template, "name", rivet.DefaultTemplate, "Name of the snapshots in archive mode, supports {host}, {path}, {timestamp} and {hash}")
+	fs.BoolVar(&o.keepDir, "keep-dir", false, "Keep the whole snapshot directory with its resources and manifest in archive mode")
+	fs.StringVar(&o.rules, "rules", "", "JSON file of the rules customizing the capture of matching URLs, see README")
+	fs.StringVar(&o.cookies, "cookies", "", "Netscape cookies.txt file of the cookies to send, e.g. for pages behind logins")
+	fs.StringVar(&o.userAgent, "user-agent", "", "User agent of the requests, overridden by the rules")
+	fs.Var(&o.header, "H", "Extra `header` of the requests to the host of the webpage in the form of \"Name: value\", may be repeated")
+	fs.IntVar(&o.hostConcurrency, "host-concurrency", 4, "Maximum number of concurrent requests to each site, 0 means no limit")
+	fs.DurationVar(&o.hostInterval, "host-interval", 0, "Minimum interval between requests to each site, e.g. 500ms")
+	fs.Int64Var(&o.maxCaptureSize, "max-capture-size", 0, "Maximum `bytes` downloaded by each capture, 0 means no limit")
+	fs.BoolVar(&o.robots, "robots", false, "Skip the webpages disallowed by the robots.txt of their sites")
+	fs.BoolVar(&o.readable, "readable", false, "Store the readable content of the webpages as article.md and article.txt too")
+	fs.StringVar(&o.workDir, "work-dir", "", "Directory in which the snapshots are captured before being stored, defaults to the temp directory")
+	fs.Int64Var(&o.minFreeSpace, "min-free-space", 0, "Minimum `bytes` free in the work directory to start a capture, 0 means no check")
+	fs.Int64Var(&o.diskBudget, "disk-budget", 0, "Maximum `bytes` downloaded and encrypted into the work directory by the captures in progress in total, 0 means no limit")
+	fs.BoolVar(&o.keepFailed, "keep-failed", false, "Keep the temp directories of the failed captures in the work directory for debugging")
+	fs.BoolVar(&o.canonical, "canonical", false, "Canonicalize the URLs before archiving, stripping tracking parameters, sorting the query and dropping fragments")
+	fs.BoolVar(&o.canonicalLink, "canonical-link", false, "Archive the webpages under the canonical URL they declare on the same site, implies -canonical")
+	fs.BoolVar(&o.https, "https", false, "Upgrade http URLs to https, implies -canonical")
+	fs.Var(&o.strip, "strip", "Query `parameter` to strip besides the tracking ones, a trailing * matches any suffix, may be repeated, implies -canonical")
+	// The default is given by the command, the server guards by default.
+	fs.BoolVar(&o.guard, "guard", o.guard, "Block the captures from reaching loopback, link-local, private and reserved addresses")
+	fs.Var(&o.block, "block", "`CIDR` range to block besides the default ones, may be repeated, implies -guard")
+	fs.Var(&o.allow, "allow", "`CIDR` range or address to allow even if blocked, may be repeated, implies -guard")
+	fs.StringVar(&o.index, "index", "", "File of the full-text index to add the readable text of the snapshots to, see rivet search")
+	fs.StringVar(&o.logLevel, "log-level", "", "Level of the logs written to stderr, supports level: debug, info, warn, error. Logs nothing by default")
+	fs.StringVar(&o.logFormat, "log-format", "text", "Format of the logs, supports format: text, json")
+	fs.Var(&o.webhooks, "webhook", "`URL` notified with a JSON POST once archiving each URL completes, may be repeated")
+	fs.StringVar(&o.webhookSecret, "webhook-secret", "", "Secret signing the notifications of the webhooks with HMAC-SHA256")
+	fs.StringVar(&o.deadLetter, "dead-letter", "", "File to which the notifications that failed to be delivered are appended")
+	fs.StringVar(&o.signingKey, "sign", "", "PEM file of the ed25519 private key signing the manifest of every snapshot")
+	fs.Var(&o.recipients, "recipient", "age public `key` to encrypt the snapshots to before pinning, may be repeated")
+	fs.StringVar(&o.passphraseFile, "passphrase-file", "", "File holding the passphrase to encrypt the snapshots with before pinning")
+}
+
+func (o *options) pinning() (ipfs.Pinning, error) {
+	opts := []ipfs.PinningOption{
+		ipfs.Mode(ipfs.Remote),
+	}
+	if o.mode == "local" {
+		opts = []ipfs.PinningOption{
+			ipfs.Mode(ipfs.Local),
+			ipfs.Host(o.host),
+			ipfs.Port(o.port),
+		}
+	}
+
+	switch o.target {
+	case pinner.Infura, pinner.Pinata, pinner.NFTStorage, pinner.Web3Storage:
+		opts = append(opts, ipfs.Uses(o.target), ipfs.Apikey(o.apikey), ipfs.Secret(o.secret))
+	default:
+		return ipfs.Pinning{}, fmt.Errorf("unknown target: %s", o.target)
+	}
+
+	return ipfs.Options(opts...), nil
+}
+
+func (o *options) shaft() (*rivet.Shaft, error) {
+	opt, err := o.pinning()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := rivet.NewClient(o.proxy, o.cacert)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []rivet.Rule
+	if o.rules != "" {
+		if rules, err = rivet.LoadRules(o.rules); err != nil {
+			return nil, err
+		}
+	}
+
+	logger, err := o.logger()
+	if err != nil {
+		return nil, err
+	}
+
+	var jar http.CookieJar
+	if o.cookies != "" {
+		if jar, err = rivet.LoadCookies(o.cookies); err != nil {
+			return nil, err
+		}
+	}
+
+	var key ed25519.PrivateKey
+	if o.signingKey != "" {
+		if key, err = rivet.LoadSigningKey(o.signingKey); err != nil {
+			return nil, err
+		}
+	}
+
+	recipients, err := o.encryption()
+	if err != nil {
+		return nil, err
+	}
+
+	var canonical *rivet.Canonical
+	if o.canonical || o.canonicalLink || o.https || len(o.strip) > 0 {
+		canonical = &rivet.Canonical{
+			Strip: append(append([]string{}, rivet.TrackingParams...), o.strip...),
+			HTTPS: o.https,
+			Link:  o.canonicalLink,
+		}
+	}
+
+	guard, err := o.guarding()
+	if err != nil {
+		return nil, err
+	}
+
+	var index *rivet.Index
+	if o.index != "" {
+		index = &rivet.Index{Path: o.index}
+	}
+
+	var webhooks []rivet.Webhook
+	for _, u := range o.webhooks {
+		webhooks = append(webhooks, rivet.Webhook{URL: u, Secret: o.webhookSecret})
+	}
+
+	return &rivet.Shaft{
+		Client:          client,
+		Jar:             jar,
+		UserAgent:       o.userAgent,
+		Header:          http.Header(o.header),
+		Hold:            opt,
+		ArchiveOnly:     o.mode == "archive",
+		Output:          o.output,
+		Template:        o.template,
+		KeepDir:         o.keepDir,
+		Rules:           rules,
+		HostConcurrency: o.hostConcurrency,
+		HostInterval:    o.hostInterval,
+		MaxCaptureSize:  o.maxCaptureSize,
+		WorkDir:         o.workDir,
+		MinFreeSpace:    o.minFreeSpace,
+		DiskBudget:      o.diskBudget,
+		KeepFailed:      o.keepFailed,
+		Robots:          o.robots,
+		Guard:           guard,
+		Readable:        o.readable,
+		Canonical:       canonical,
+		Index:           index,
+		Logger:          logger,
+		Webhooks:        webhooks,
+		DeadLetter:      o.deadLetter,
+		SigningKey:      key,
+		Recipients:      recipients,
+	}, nil
+}
+
+// guarding returns the guard of the captures, nil if they are not guarded.
+func (o *options) guarding() (*rivet.Guard, error) {
+	if !o.guard && len(o.block) == 0 && len(o.allow) == 0 {
+		return nil, nil
+	}
+	var (
+		g   = &rivet.Guard{}
+		err error
+	)
+	if g.Block, err = prefixes(o.block); err != nil {
+		return nil, err
+	}
+	if g.Allow, err = prefixes(o.allow); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// prefixes parses the CIDR ranges, a lone address is a range of its own.
+func prefixes(ranges []string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, r := range ranges {
+		if addr, err := netip.ParseAddr(r); err == nil {
+			ps = append(ps, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %s", r)
+		}
+		ps = append(ps, p.Masked())
+	}
+	return ps, nil
+}
+
+// encryption returns the recipients of the snapshots, nil if they are not encrypted.
+func (o *options) encryption() ([]age.Recipient, error) {
+	if o.passphraseFile == "" {
+		var recipients []age.Recipient
+		for _, s := range o.recipients {
+			r, err := age.ParseX25519Recipient(s)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+		}
+		return recipients, nil
+	}
+
+	if len(o.recipients) > 0 {
+		return nil, fmt.Errorf("-passphrase-file cannot be combined with -recipient")
+	}
+	pass, err := readPassphrase(o.passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.NewScryptRecipient(pass)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Recipient{r}, nil
+}
+
+// readPassphrase returns the first line of the file.
+func readPassphrase(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pass := strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r")
+	if pass == "" {
+		return "", fmt.Errorf("passphrase is empty: %s", path)
+	}
+	return pass, nil
+}
+
+// logger returns the logger writing to stderr, or nil if no level is given.
+func (o *options) logger() (*slog.Logger, error) {
+	if o.logLevel == "" {
+		return nil, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.logLevel)); err != nil {
+		return nil, fmt.Errorf("unknown log level: %s", o.logLevel)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch o.logFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", o.logFormat)
+	}
+}
+
+// headers is a flag collecting the headers given in the form of "Name: value".
+type headers http.Header
+
+func (h *headers) String() string {
+	var b strings.Builder
+	_ = http.Header(*h).Write(&b)
+	return strings.TrimSpace(b.String())
+}
+
+func (h *headers) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", value)
+	}
+	if *h == nil {
+		*h = make(headers)
+	}
+	http.Header(*h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
+
+// list is a flag collecting the values given repeatedly.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *list) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (o *options) deadline() time.Duration {
+	return time.Duration(o.timeout) * time.Second
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wabarc/rivet"
+)
+
+// redrawInterval is the minimum interval between redraws of the progress.
+const redrawInterval = 100 * time.Millisecond
+
+// maxURLWidth keeps the lines of the progress from wrapping, which would break redraws.
+const maxURLWidth = 60
+
+// status is the progress of archiving a URL.
+type status struct {
+	url       string
+	stage     rivet.Stage
+	resources int
+	fetched   int64
+	uploaded  int64
+}
+
+// display renders the progress of the URLs being archived on a terminal, one
+// line for each URL, below the lines printed by println.
+type display struct {
+	mu     sync.Mutex
+	w      io.Writer
+	active []*status
+	lines  int // number of lines drawn
+	drawn  time.Time
+}
+
+var _ rivet.Progress = (*display)(nil)
+
+// newDisplay returns a display rendering on stderr, or nil if it is not a terminal.
+func newDisplay() *display {
+	fi, err := os.Stderr.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &display{w: os.Stderr}
+}
+
+func (d *display) Stage(u *url.URL, stage rivet.Stage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := d.status(u)
+	if st == nil {
+		st = &status{url: u.String()}
+		d.active = append(d.active, st)
+	}
+	st.stage = stage
+	if stage == rivet.StageDone || stage == rivet.StageFailed {
+		for i := range d.active {
+			if d.active[i] == st {
+				d.active = append(d.active[:i], d.active[i+1:]...)
+				break
+			}
+		}
+	}
+	d.draw(true)
+}
+
+func (d *display) Fetched(u *url.URL, _ *url.URL, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if st := d.status(u); st != nil {
+		st.resources++
+		st.fetched += size
+		d.draw(false)
+	}
+}
+
+func (d *display) Uploaded(u *url.URL, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if st := d.status(u); st != nil {
+		st.uploaded = n
+		d.draw(false)
+	}
+}
+
+// printf writes above the progress, or straight to w if d is nil.
+func (d *display) printf(w io.Writer, format string, args ...interface{}) {
+	if d == nil {
+		fmt.Fprintf(w, format, args...)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.clear()
+	fmt.Fprintf(w, format, args...)
+	d.draw(true)
+}
+
+// status returns the status of the URL, nil if it is not being archived.
+func (d *display) status(u *url.URL) *status {
+	link := u.String()
+	for _, st := range d.active {
+		if st.url == link {
+			return st
+		}
+	}
+	return nil
+}
+
+func (d *display) clear() {
+	if d.lines > 0 {
+		// Moves to the first line drawn and clears the rest of the screen.
+		fmt.Fprintf(d.w, "\x1b[%dF\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+// draw redraws the progress, unless it was drawn recently and force is not set.
+func (d *display) draw(force bool) {
+	if !force && time.Since(d.drawn) < redrawInterval {
+		return
+	}
+	d.clear()
+
+	var b strings.Builder
+	for _, st := range d.active {
+		link := st.url
+		if len(link) > maxURLWidth {
+			link = link[:maxURLWidth-3] + "..."
+		}
+		fmt.Fprintf(&b, "%-8s %s", st.stage, link)
+		if st.resources > 0 {
+			fmt.Fprintf(&b, "  %d resources, %s", st.resources, bytesize(st.fetched))
+		}
+		if st.stage == rivet.StagePin && st.uploaded > 0 {
+			fmt.Fprintf(&b, "  %s uploaded", bytesize(st.uploaded))
+		}
+		b.WriteByte('\n')
+	}
+	io.WriteString(d.w, b.String()) // nolint:errcheck
+	d.lines = len(d.active)
+	d.drawn = time.Now()
+}
+
+func bytesize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wabarc/rivet"
+)
+
+func search(args []string) {
+	var (
+		index  string
+		limit  int
+		asJSON bool
+	)
+
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet search [options] query\n\n")
+
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&index, "index", "", "Index file to search, as given to -index when archiving")
+	fs.IntVar(&limit, "n", 10, "Maximum number of snapshots to list, 0 means no limit")
+	fs.BoolVar(&asJSON, "json", false, "List the snapshots as JSON lines")
+	_ = fs.Parse(args)
+
+	if index == "" {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "-index is missing")
+		os.Exit(1)
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "query is missing")
+		os.Exit(1)
+	}
+
+	x := &rivet.Index{Path: index}
+	hits, err := x.Search(context.Background(), strings.Join(fs.Args(), " "), limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, h := range hits {
+		if asJSON {
+			_ = enc.Encode(h)
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s  %s  %s\n", h.Dest, h.Captured.Format(time.RFC3339), h.URL)
+		if h.Title != "" {
+			fmt.Fprintf(os.Stdout, "    %s\n", h.Title)
+		}
+	}
+}
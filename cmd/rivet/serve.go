@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wabarc/rivet"
+	"github.com/wabarc/rivet/metrics"
+)
+
+// maxInputSize is the maximum size of a webpage submitted to the server.
+const maxInputSize = 64 << 20
+
+func serve(args []string) {
+	var (
+		// The server fetches the URLs given by anyone.
+		opts    = options{guard: true}
+		listen  string
+		token   string
+		origins list
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet serve [options]\n\n")
+
+		fs.PrintDefaults()
+	}
+	opts.register(fs)
+	fs.StringVar(&listen, "listen", "127.0.0.1:8080", "Address to serve HTTP requests on")
+	fs.StringVar(&token, "token", "", "Token required to archive, as a bearer token or the token parameter")
+	fs.Var(&origins, "origin", "`Origin` allowed to archive cross-origin, e.g. https://example.com, may be repeated, * allows any")
+	_ = fs.Parse(args)
+
+	r, err := opts.shaft()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+	r.Metrics = metrics.New()
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           newServer(&server{shaft: r, timeout: opts.deadline(), token: token, origins: origins}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Fprintf(os.Stdout, "rivet: listening on %s\n", listen)
+	if err := srv.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type server struct {
+	shaft   *rivet.Shaft
+	timeout time.Duration
+	token   string   // required to archive if set
+	origins []string // allowed to archive cross-origin
+}
+
+type result struct {
+	URL       string `json:"url"`
+	Canonical string `json:"canonical,omitempty"`
+	Dest      string `json:"dest,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// archived returns the result of archiving the webpage of the given link.
+func archived(link string, res *rivet.Result) result {
+	r := result{URL: link, Dest: res.Dest, Title: res.Title}
+	if res.URL != link {
+		r.Canonical = res.URL
+	}
+	return r
+}
+
+func newServer(s *server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wayback", s.wayback)
+	if s.shaft.Index != nil {
+		mux.HandleFunc("/search", s.search)
+	}
+	// Exports the metrics to Prometheus.
+	if h, ok := s.shaft.Metrics.(http.Handler); ok {
+		mux.Handle("/metrics", h)
+	}
+
+	return mux
+}
+
+// wayback archives the webpage given by the url parameter. The page may be
+// submitted by the caller, either as a text/html request body, a form field
+// named html or a file uploaded as input; otherwise it is fetched as usual.
+func (s *server) wayback(w http.ResponseWriter, r *http.Request) {
+	// Allows bookmarklets and browser extensions to submit pages from the allowed origins.
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && s.allowed(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	}
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		reply(w, http.StatusMethodNotAllowed, result{Error: "method not allowed"})
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		reply(w, http.StatusUnauthorized, result{Error: "unauthorized"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxInputSize)
+	link, page, err := parseSubmission(r)
+	if err != nil {
+		reply(w, http.StatusBadRequest, result{URL: link, Error: err.Error()})
+		return
+	}
+	input, err := url.Parse(link)
+	if err != nil || input.Scheme == "" || input.Host == "" {
+		reply(w, http.StatusBadRequest, result{URL: link, Error: "invalid url"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+	// Correlates the logs with the request of the caller, e.g. a reverse proxy.
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		ctx = rivet.WithRequestID(ctx, id)
+	}
+	if page != nil {
+		ctx = s.shaft.WithInput(ctx, page)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.stream(ctx, w, input)
+		return
+	}
+
+	res, err := s.shaft.Archive(ctx, input)
+	if err != nil {
+		reply(w, http.StatusBadGateway, result{URL: link, Error: err.Error()})
+		return
+	}
+	reply(w, http.StatusOK, archived(link, res))
+}
+
+// allowed reports whether the origin may archive cross-origin.
+func (s *server) allowed(origin string) bool {
+	for _, o := range s.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether the request carries the token, if one is required.
+func (s *server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// maxSearchResults is the maximum number of snapshots returned by a search.
+const maxSearchResults = 100
+
+// search returns the snapshots matching the q parameter, at most the
+// number given by the n parameter, defaulting to 10. It is not shared
+// cross-origin, lest any website read the index through the browsers.
+func (s *server) search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		reply(w, http.StatusMethodNotAllowed, result{Error: "method not allowed"})
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) == "" {
+		reply(w, http.StatusBadRequest, result{Error: "query is missing"})
+		return
+	}
+	limit := 10
+	if n := r.URL.Query().Get("n"); n != "" {
+		var err error
+		if limit, err = strconv.Atoi(n); err != nil || limit < 1 {
+			reply(w, http.StatusBadRequest, result{Error: "invalid n"})
+			return
+		}
+	}
+	if limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+
+	hits, err := s.shaft.Index.Search(r.Context(), query, limit)
+	if err != nil {
+		reply(w, http.StatusInternalServerError, result{Error: err.Error()})
+		return
+	}
+	if hits == nil {
+		hits = []rivet.Hit{}
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"query": query, "results": hits})
+}
+
+// stream archives the webpage, sending its progress and then the result as server-sent events.
+func (s *server) stream(ctx context.Context, w http.ResponseWriter, input *url.URL) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ev := &events{w: w}
+	ev.flusher, _ = w.(http.Flusher)
+	ev.flush()
+
+	res, err := s.shaft.Archive(rivet.WithProgress(ctx, ev), input)
+	if err != nil {
+		ev.send("result", result{URL: input.String(), Error: err.Error()})
+	} else {
+		ev.send("result", archived(input.String(), res))
+	}
+	ev.close()
+}
+
+// events sends the progress of archiving a webpage as server-sent events.
+type events struct {
+	mu       sync.Mutex
+	w        io.Writer
+	flusher  http.Flusher
+	uploaded time.Time // when the last uploaded event was sent
+	closed   bool
+}
+
+func (e *events) Stage(u *url.URL, stage rivet.Stage) {
+	e.send("stage", map[string]interface{}{"url": u.String(), "stage": stage})
+}
+
+func (e *events) Fetched(u *url.URL, resource *url.URL, size int64) {
+	e.send("fetched", map[string]interface{}{"url": u.String(), "resource": resource.String(), "size": size})
+}
+
+func (e *events) Uploaded(u *url.URL, n int64) {
+	e.mu.Lock()
+	// Uploads report every chunk, which is more than clients need.
+	throttled := time.Since(e.uploaded) < 100*time.Millisecond
+	if !throttled {
+		e.uploaded = time.Now()
+	}
+	e.mu.Unlock()
+	if !throttled {
+		e.send("uploaded", map[string]interface{}{"url": u.String(), "bytes": n})
+	}
+}
+
+func (e *events) send(event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Resources may be reported after the handler returned.
+	if e.closed {
+		return
+	}
+	fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, data)
+	e.flush()
+}
+
+func (e *events) flush() {
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+}
+
+func (e *events) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+}
+
+func parseSubmission(r *http.Request) (link string, page []byte, err error) {
+	link = r.URL.Query().Get("url")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/html":
+		page, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return link, nil, err
+		}
+	case "multipart/form-data":
+		if err = r.ParseMultipartForm(maxInputSize); err != nil {
+			return link, nil, err
+		}
+		if f, _, err := r.FormFile("input"); err == nil {
+			defer f.Close()
+			if page, err = ioutil.ReadAll(f); err != nil {
+				return link, nil, err
+			}
+		}
+	default:
+		if err = r.ParseForm(); err != nil {
+			return link, nil, err
+		}
+	}
+
+	if link == "" {
+		link = r.PostFormValue("url")
+	}
+	if page == nil && r.PostFormValue("html") != "" {
+		page = []byte(r.PostFormValue("html"))
+	}
+	if link == "" {
+		return link, nil, fmt.Errorf("url is missing")
+	}
+
+	return link, page, nil
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
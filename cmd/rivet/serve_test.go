@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wabarc/helper"
+	"github.com/wabarc/rivet"
+)
+
+const (
+	testURL  = "http://example.com/"
+	testPage = `<html>
+<head><title>%s</title></head>
+<body>
+<div>
+    <h1>%[1]s</h1>
+    <p>A rivet is a permanent mechanical fastener. Before being installed, a rivet consists of a smooth
+    cylindrical shaft with a head on one end. The end opposite the head is called the tail.</p>
+</div>
+</body>
+</html>
+`
+)
+
+// newTestServer returns the handler of the server archiving into a temporary
+// directory, and indexing the snapshots, from a mock server serving the webpage
+// titled Fetched.
+func newTestServer(t *testing.T) (http.Handler, *rivet.Shaft) {
+	client, mux, mock := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, testPage, "Fetched")
+	})
+	t.Cleanup(mock.Close)
+
+	r := &rivet.Shaft{
+		Client:      client,
+		ArchiveOnly: true,
+		Output:      t.TempDir(),
+		Index:       &rivet.Index{Path: filepath.Join(t.TempDir(), "index.jsonl")},
+	}
+	return newServer(&server{shaft: r, timeout: time.Minute}), r
+}
+
+func TestWayback(t *testing.T) {
+	h, _ := newTestServer(t)
+
+	multipartBody := func(fields map[string]string, file string) (string, string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for k, v := range fields {
+			_ = mw.WriteField(k, v)
+		}
+		if file != "" {
+			fw, _ := mw.CreateFormFile("input", "page.html")
+			_, _ = fw.Write([]byte(file))
+		}
+		mw.Close()
+		return mw.FormDataContentType(), b.String()
+	}
+	submitted := fmt.Sprintf(testPage, "Submitted")
+	multipartType, multipartData := multipartBody(map[string]string{"url": testURL}, submitted)
+	fetchedType, fetchedData := multipartBody(map[string]string{"url": testURL}, "")
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+
+		code  int
+		title string
+		err   string
+	}{
+		{
+			name:        "html",
+			method:      http.MethodPost,
+			target:      "/wayback?url=" + url.QueryEscape(testURL),
+			contentType: "text/html; charset=utf-8",
+			body:        submitted,
+			code:        http.StatusOK,
+			title:       "Submitted",
+		},
+		{
+			name:        "multipart",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: multipartType,
+			body:        multipartData,
+			code:        http.StatusOK,
+			title:       "Submitted",
+		},
+		{
+			name:        "multipart without input",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: fetchedType,
+			body:        fetchedData,
+			code:        http.StatusOK,
+			title:       "Fetched",
+		},
+		{
+			name:        "form",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"url": {testURL}, "html": {submitted}}.Encode(),
+			code:        http.StatusOK,
+			title:       "Submitted",
+		},
+		{
+			name:        "form without html",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"url": {testURL}}.Encode(),
+			code:        http.StatusOK,
+			title:       "Fetched",
+		},
+		{
+			name:        "missing url",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"html": {submitted}}.Encode(),
+			code:        http.StatusBadRequest,
+			err:         "url is missing",
+		},
+		{
+			name:        "invalid url",
+			method:      http.MethodPost,
+			target:      "/wayback",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"url": {"example.com"}}.Encode(),
+			code:        http.StatusBadRequest,
+			err:         "invalid url",
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			target: "/wayback?url=" + url.QueryEscape(testURL),
+			code:   http.StatusMethodNotAllowed,
+			err:    "method not allowed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != test.code {
+				t.Fatalf("Unexpected status code got %d instead of %d: %s", w.Code, test.code, w.Body)
+			}
+			if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+				t.Errorf("Unexpected allowed origin: %q", origin)
+			}
+			var res result
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("Unexpected response: %v", err)
+			}
+			if res.Error != test.err || res.Title != test.title {
+				t.Errorf("Unexpected result: %+v", res)
+			}
+			if test.code == http.StatusOK && (res.URL != testURL || res.Dest == "") {
+				t.Errorf("Unexpected result of the archived webpage: %+v", res)
+			}
+		})
+	}
+
+	// No origin is allowed by default.
+	req := httptest.NewRequest(http.MethodOptions, "/wayback", nil)
+	req.Header.Set("Origin", "https://example.org")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Unexpected preflight response: %d, %v", w.Code, w.Header())
+	}
+}
+
+func TestWaybackAccess(t *testing.T) {
+	_, r := newTestServer(t)
+	h := newServer(&server{shaft: r, timeout: time.Minute, token: "secret", origins: []string{"https://allowed.example"}})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		auth   string
+		origin string
+
+		code    int
+		allowed string
+	}{
+		{"without token", http.MethodPost, "/wayback", "", "", http.StatusUnauthorized, ""},
+		{"wrong token", http.MethodPost, "/wayback?token=public", "", "", http.StatusUnauthorized, ""},
+		{"wrong bearer token", http.MethodPost, "/wayback?token=secret", "Bearer public", "", http.StatusUnauthorized, ""},
+		{"bearer token", http.MethodPost, "/wayback", "Bearer secret", "", http.StatusOK, ""},
+		{"token parameter", http.MethodPost, "/wayback?token=secret", "", "", http.StatusOK, ""},
+		{"allowed origin", http.MethodPost, "/wayback?token=secret", "", "https://allowed.example", http.StatusOK, "https://allowed.example"},
+		{"other origin", http.MethodPost, "/wayback?token=secret", "", "https://example.org", http.StatusOK, ""},
+		{"preflight of allowed origin", http.MethodOptions, "/wayback", "", "https://allowed.example", http.StatusNoContent, "https://allowed.example"},
+		{"preflight of other origin", http.MethodOptions, "/wayback", "", "https://example.org", http.StatusNoContent, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := test.target
+			if test.method == http.MethodPost {
+				sep := "?"
+				if strings.Contains(target, "?") {
+					sep = "&"
+				}
+				target += sep + "url=" + url.QueryEscape(testURL)
+			}
+			req := httptest.NewRequest(test.method, target, nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != test.code {
+				t.Fatalf("Unexpected status code got %d instead of %d: %s", w.Code, test.code, w.Body)
+			}
+			if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != test.allowed {
+				t.Errorf("Unexpected allowed origin got %q instead of %q", origin, test.allowed)
+			}
+			if test.allowed != "" && !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+				t.Errorf("Unexpected allowed headers: %v", w.Header())
+			}
+		})
+	}
+
+	// Any origin is allowed with *.
+	h = newServer(&server{shaft: r, timeout: time.Minute, origins: []string{"*"}})
+	req := httptest.NewRequest(http.MethodOptions, "/wayback", nil)
+	req.Header.Set("Origin", "https://example.org")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "https://example.org" {
+		t.Errorf("Unexpected allowed origin of any origin: %q", origin)
+	}
+}
+
+// event is a server-sent event.
+type event struct {
+	name string
+	data string
+}
+
+func readEvents(t *testing.T, body *bytes.Buffer) (events []event) {
+	var e event
+	s := bufio.NewScanner(body)
+	for s.Scan() {
+		switch line := s.Text(); {
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, e)
+			e = event{}
+		default:
+			t.Fatalf("Unexpected line of the event stream: %q", line)
+		}
+	}
+	return events
+}
+
+// sequence returns the names of the events, along with their stages,
+// the fetched events that follow one another are reported once.
+func sequence(t *testing.T, events []event) string {
+	var seq []string
+	for _, e := range events {
+		name := e.name
+		if e.name == "stage" {
+			var v struct{ Stage string }
+			if err := json.Unmarshal([]byte(e.data), &v); err != nil {
+				t.Fatalf("Unexpected data of stage event: %v", err)
+			}
+			name += ":" + v.Stage
+		}
+		if len(seq) > 0 && name == "fetched" && seq[len(seq)-1] == name {
+			continue
+		}
+		seq = append(seq, name)
+	}
+	return strings.Join(seq, " ")
+}
+
+func TestWaybackStream(t *testing.T) {
+	h, r := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/wayback?url="+url.QueryEscape(testURL), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %d, %v", w.Code, w.Header())
+	}
+	events := readEvents(t, w.Body)
+	expected := "stage:capture fetched stage:store stage:done result"
+	if seq := sequence(t, events); seq != expected {
+		t.Fatalf("Unexpected events got %q instead of %q", seq, expected)
+	}
+	var res result
+	if err := json.Unmarshal([]byte(events[len(events)-1].data), &res); err != nil {
+		t.Fatalf("Unexpected result event: %v", err)
+	}
+	if res.URL != testURL || res.Dest == "" || res.Title != "Fetched" || res.Error != "" {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+
+	// The failure is reported as the result.
+	r.MinFreeSpace = 1 << 62
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	events = readEvents(t, w.Body)
+	expected = "stage:capture stage:failed result"
+	if seq := sequence(t, events); seq != expected {
+		t.Fatalf("Unexpected events of the failure got %q instead of %q", seq, expected)
+	}
+	if err := json.Unmarshal([]byte(events[len(events)-1].data), &res); err != nil {
+		t.Fatalf("Unexpected result event: %v", err)
+	}
+	if !strings.Contains(res.Error, "space") {
+		t.Errorf("Unexpected result of the failure: %+v", res)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	h, r := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/wayback?url="+url.QueryEscape(testURL), nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected wayback: %d, %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+		hits   int
+	}{
+		{http.MethodGet, "/search?q=fastener", http.StatusOK, 1},
+		{http.MethodGet, "/search?q=fastener&n=1000", http.StatusOK, 1},
+		{http.MethodGet, "/search?q=bolt", http.StatusOK, 0},
+		{http.MethodGet, "/search?q=+", http.StatusBadRequest, 0},
+		{http.MethodGet, "/search?q=fastener&n=0", http.StatusBadRequest, 0},
+		{http.MethodGet, "/search?q=fastener&n=x", http.StatusBadRequest, 0},
+		{http.MethodPost, "/search?q=fastener", http.StatusMethodNotAllowed, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.code {
+			t.Errorf("Unexpected status code of %s %s got %d instead of %d", test.method, test.target, w.Code, test.code)
+			continue
+		}
+		if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+			t.Errorf("Unexpected allowed origin of %s: %q", test.target, origin)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res struct {
+			Query   string
+			Results []rivet.Hit
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+		if res.Results == nil || len(res.Results) != test.hits {
+			t.Errorf("Unexpected results of %s: %s", test.target, w.Body)
+		}
+		if test.hits > 0 && (res.Results[0].URL != testURL || res.Results[0].Title != "Fetched") {
+			t.Errorf("Unexpected hit of %s: %+v", test.target, res.Results[0])
+		}
+	}
+
+	// Searching is only served with an index.
+	r.Index = nil
+	w = httptest.NewRecorder()
+	newServer(&server{shaft: r, timeout: time.Minute}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/search?q=fastener", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code of search without index: %d", w.Code)
+	}
+}
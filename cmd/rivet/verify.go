@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wabarc/rivet"
+	"github.com/wabarc/rivet/ipfs"
+)
+
+// source holds the flags of the commands that fetch snapshots from IPFS.
+type source struct {
+	gateway string
+	local   bool
+	host    string
+	port    int
+	timeout uint
+	proxy   string
+	cacert  string
+}
+
+func (s *source) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.gateway, "gateway", ipfs.DefaultGateway, "IPFS gateway to fetch blocks from")
+	fs.BoolVar(&s.local, "local", false, "Fetch blocks from the local IPFS node instead of a gateway")
+	fs.StringVar(&s.host, "host", "localhost", "IPFS node address")
+	fs.IntVar(&s.port, "port", 5001, "IPFS node port")
+	fs.UintVar(&s.timeout, "timeout", 300, "Timeout for the verification")
+	fs.StringVar(&s.proxy, "proxy", "", "Proxy of the requests to the gateway, e.g. socks5://127.0.0.1:9050")
+	fs.StringVar(&s.cacert, "cacert", "", "PEM file of the certificate authorities to trust besides the system ones")
+}
+
+func (s *source) fetcher() (ipfs.Fetcher, error) {
+	client, err := rivet.NewClient(s.proxy, s.cacert)
+	if err != nil {
+		return nil, err
+	}
+	if s.local {
+		opt := ipfs.Options(ipfs.Mode(ipfs.Local), ipfs.Host(s.host), ipfs.Port(s.port), ipfs.Client(client))
+		return &ipfs.Locally{Pinning: opt}, nil
+	}
+	return &ipfs.Gateway{URL: s.gateway, Client: client}, nil
+}
+
+func (s *source) deadline() time.Duration {
+	return time.Duration(s.timeout) * time.Second
+}
+
+func verify(args []string) {
+	var (
+		src      source
+		manifest string
+		dir      string
+	)
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet verify [options] cid\n\n")
+
+		fs.PrintDefaults()
+	}
+	src.register(fs)
+	fs.StringVar(&manifest, "manifest", "", "Compare with the given manifest instead of the one in the snapshot")
+	fs.StringVar(&dir, "dir", "", "Compare with the given source directory instead of the manifest in the snapshot")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "cid is missing")
+		os.Exit(1)
+	}
+	cid := fs.Arg(0)
+
+	f, err := src.fetcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	var m *rivet.Manifest
+	switch {
+	case manifest != "":
+		m, err = rivet.ReadManifest(manifest)
+	case dir != "":
+		m, err = rivet.NewManifest(dir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), src.deadline())
+	defer cancel()
+
+	v, err := rivet.Verify(ctx, f, cid, m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+	if !report(cid, v) {
+		fmt.Fprintln(os.Stdout, "FAIL")
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stdout, "OK")
+}
+
+// report prints the verification of the snapshot and reports whether it is OK.
+func report(cid string, v *rivet.Verification) bool {
+	fmt.Fprintf(os.Stdout, "%s  %d blocks, %d files\n", cid, v.Blocks, len(v.Files))
+	for _, c := range v.Missing {
+		fmt.Fprintf(os.Stdout, "missing block  %s\n", c)
+	}
+	for _, c := range v.Corrupt {
+		fmt.Fprintf(os.Stdout, "corrupt block  %s\n", c)
+	}
+	for _, mm := range v.Mismatches {
+		fmt.Fprintf(os.Stdout, "mismatch  %s\n", mm)
+	}
+	if v.Manifest == nil {
+		fmt.Fprintln(os.Stdout, "no manifest, only blocks have been verified")
+	}
+	return v.OK()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/wabarc/rivet"
+)
+
+func watch(args []string) {
+	var (
+		opts     options
+		interval time.Duration
+		spec     string
+		state    string
+	)
+
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "Usage:\n\n")
+		fmt.Fprintf(os.Stdout, "  rivet watch [options] [url1] ... [urlN]\n\n")
+
+		fs.PrintDefaults()
+	}
+	opts.register(fs)
+	fs.DurationVar(&interval, "interval", time.Hour, "Interval between re-archiving the URLs")
+	fs.StringVar(&spec, "cron", "", "Cron expression telling when to re-archive the URLs, instead of -interval")
+	fs.StringVar(&state, "state", "rivet-watch.json", "File to record the last snapshot of each URL in, for detecting changes across restarts")
+	_ = fs.Parse(args)
+
+	var (
+		schedule = rivet.Every(interval)
+		err      error
+	)
+	if spec != "" {
+		if schedule, err = rivet.ParseCron(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	r, err := opts.shaft()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		fmt.Fprintln(os.Stderr, "link is missing")
+		os.Exit(1)
+	}
+	inputs := make([]*url.URL, 0, fs.NArg())
+	for _, link := range fs.Args() {
+		input, err := url.Parse(link)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+			os.Exit(1)
+		}
+		inputs = append(inputs, input)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	w := &rivet.Watch{Shaft: r, Schedule: schedule, Timeout: opts.deadline(), State: state}
+	err = w.Run(ctx, inputs, func(c rivet.Capture) {
+		switch {
+		case c.Err != nil:
+			fmt.Fprintf(os.Stderr, "rivet: %s: %v\n", c.URL, c.Err)
+		case c.Changed:
+			fmt.Fprintf(os.Stdout, "%s  %s\n", c.Dest, c.URL)
+		default:
+			fmt.Fprintf(os.Stdout, "%s  %s (unchanged)\n", c.Dest, c.URL)
+		}
+	})
+	r.Wait()
+	if err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "rivet: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+)
+
+// httpOnlyPrefix marks the HttpOnly cookies in the files written by curl and browser extensions.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// LoadCookies reads the cookies from a Netscape cookies.txt file, as exported by
+// browser extensions or written by curl, into a cookie jar.
+func LoadCookies(path string) (http.CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseCookies(f)
+}
+
+// ParseCookies parses the cookies in Netscape cookies.txt format into a cookie jar.
+// Each line holds the tab-separated fields: domain, whether subdomains are included,
+// path, whether it is secure, expiration time in Unix seconds, name and value.
+func ParseCookies(r io.Reader) (http.CookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = line[len(httpOnlyPrefix):]
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, errors.Errorf("invalid cookie at line %d: expected 7 fields", n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid cookie expiration at line %d: %s", n, fields[4])
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		// Host-only cookies leave the domain empty.
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+		// Zero means a session cookie.
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+
+		u := &url.URL{Scheme: "http", Host: domain, Path: cookie.Path}
+		if cookie.Secure {
+			u.Scheme = "https"
+		}
+		jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return jar, nil
+}
+
+// jarTransport applies the cookies of the jar to the requests,
+// and records the cookies set by the responses.
+type jarTransport struct {
+	base http.RoundTripper
+	jar  http.CookieJar
+}
+
+func (t *jarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cookies := t.jar.Cookies(req.URL); len(cookies) > 0 {
+		// The request must not be modified, see http.RoundTripper.
+		req = req.Clone(req.Context())
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		t.jar.SetCookies(req.URL, cookies)
+	}
+	return resp, nil
+}
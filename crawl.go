@@ -0,0 +1,382 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"github.com/kennygrant/sanitize"
+	"github.com/pkg/errors"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// Crawl describes which pages a site crawl follows.
+type Crawl struct {
+	// Depth is the maximum number of links followed from the seed URL,
+	// zero archives the seed URL only.
+	Depth int
+
+	// Limit is the maximum number of pages to archive, zero means no limit.
+	Limit int
+
+	// Prefix restricts the crawl to the pages whose path starts with it.
+	Prefix string
+
+	// Match restricts the crawl to the URLs it matches. If set, it replaces
+	// the restriction to the host and path prefix of the seed URL.
+	Match *regexp.Regexp
+
+	// Timeout limits the time of archiving every page, zero means no limit.
+	// A page timing out is skipped, unless it is the seed page.
+	Timeout time.Duration
+}
+
+// inScope reports whether the crawl of the site at root follows the link to u, root
+// is the URL the seed page ends up at after redirects.
+func (c *Crawl) inScope(root, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if c.Match != nil {
+		return c.Match.MatchString(u.String())
+	}
+	return strings.EqualFold(u.Host, root.Host) && strings.HasPrefix(u.Path, c.Prefix)
+}
+
+// page is a webpage archived by a crawl.
+type page struct {
+	url   *url.URL
+	from  *url.URL // the URL requested if it redirected to url
+	depth int
+	dir   string // slash-separated path of the page directory relative to the snapshot
+
+	// title and text are the readable content of the page, only extracted if Readable or Index is set.
+	title string
+	text  string
+}
+
+// Crawl archives the site starting from the seed URL and following the links in the
+// scope of c. Each page is archived into its own subdirectory with the links to other
+// archived pages rewritten to relative paths, and the whole site is pinned as one
+// directory. If ArchiveOnly is set, the directory is stored in the output directory.
+func (s *Shaft) Crawl(ctx context.Context, seed *url.URL, c Crawl) (dest string, err error) {
+	ctx = s.begin(ctx, seed)
+	defer func() {
+		s.notify(ctx, seed, dest, "", err)
+		track(ctx).finish(err)
+	}()
+
+	snap, pages, err := s.captureSite(ctx, seed, c)
+	if err != nil {
+		return "", err
+	}
+	defer func() { s.discard(ctx, snap.dir, snap.budget, err) }()
+
+	if s.ArchiveOnly {
+		track(ctx).stage(StageStore)
+		dest, err = s.keepDir(snap)
+	} else {
+		dest, err = s.pin(ctx, snap.dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, p := range pages {
+		doc := Document{URL: p.url.String(), Captured: snap.manifest.Captured, Dest: pageDest(dest, p), Title: p.title}
+		s.index(ctx, doc, p.text)
+	}
+	return dest, nil
+}
+
+// pageDest returns the destination of the page within the snapshot of the site stored at dest.
+func pageDest(dest string, p *page) string {
+	if strings.HasPrefix(dest, gateway) {
+		return dest + "/" + p.dir + "/"
+	}
+	return filepath.Join(dest, filepath.FromSlash(p.dir))
+}
+
+// captureSite crawls the site into a temporary directory, which the caller must remove,
+// and returns its pages as well.
+func (s *Shaft) captureSite(ctx context.Context, seed *url.URL, c Crawl) (snap *snapshot, pages []*page, err error) {
+	if s.Metrics != nil {
+		defer func(start time.Time) {
+			var size int64
+			if err == nil {
+				size = snap.manifest.size()
+			}
+			s.Metrics.ObserveCapture(time.Since(start), size, err)
+		}(time.Now())
+	}
+
+	track(ctx).stage(StageCapture)
+	if err := s.admit(ctx); err != nil {
+		return nil, nil, err
+	}
+	ctx = s.withBudget(ctx)
+	given := seed
+	seed = s.canonicalize(seed)
+	dir, err := mkdir(ctx, s.WorkDir, sanitize.BaseName(seed.Host)+sanitize.BaseName(seed.Path))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.discard(ctx, dir, budgetFrom(ctx), err)
+		}
+	}()
+
+	captured := time.Now()
+	pages, err = s.crawl(ctx, seed, c, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pages) == 0 {
+		return nil, nil, errors.New("archive failed: no page archived")
+	}
+
+	// Rewrite links once all of the pages are known.
+	archived := make(map[string]*page, len(pages))
+	for _, p := range pages {
+		archived[p.url.String()] = p
+		if p.from != nil {
+			archived[p.from.String()] = p
+		}
+	}
+	for _, p := range pages {
+		if err := relink(dir, p, archived); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := writeSiteIndex(dir, pages); err != nil {
+		return nil, nil, err
+	}
+
+	m, err := writeManifest(dir, Manifest{URL: seed.String(), Original: original(given, seed), Captured: captured, Source: SourceFetched})
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.SigningKey != nil {
+		if err := attest(dir, m, s.SigningKey); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &snapshot{url: seed, dir: dir, file: "index.html", manifest: m, budget: budgetFrom(ctx)}, pages, nil
+}
+
+// crawl archives the pages breadth-first into subdirectories of dir. Pages that
+// fail to be archived are skipped, except for the seed page. The scope is of the
+// URL the seed page ends up at after redirects.
+func (s *Shaft) crawl(ctx context.Context, seed *url.URL, c Crawl, dir string) ([]*page, error) {
+	var (
+		pages []*page
+		root  = seed
+		queue = []*page{{url: withoutFragment(seed)}}
+		seen  = map[string]bool{queue[0].url.String(): true}
+		names = map[string]bool{}
+	)
+	for len(queue) > 0 && (c.Limit <= 0 || len(pages) < c.Limit) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p := queue[0]
+		queue = queue[1:]
+
+		p.dir = pageDir(root, p.url, names)
+		pageDir := filepath.Join(dir, filepath.FromSlash(p.dir))
+		if err := os.MkdirAll(pageDir, 0700); err != nil {
+			return nil, errors.Wrap(err, "create page directory failed")
+		}
+
+		final, err := s.archivePage(ctx, c, p.url, pageDir)
+		if err != nil {
+			// The budget is of the whole site, the pages left would fail as well.
+			if len(pages) == 0 || errors.Is(err, ErrTooLarge) || errors.Is(err, ErrNoSpace) {
+				return nil, err
+			}
+			_ = os.RemoveAll(pageDir)
+			continue
+		}
+		// The links of the page are relative to where it redirected.
+		if final != nil && withoutFragment(final).String() != p.url.String() {
+			p.from, p.url = p.url, withoutFragment(final)
+			if len(pages) > 0 && (seen[p.url.String()] || !c.inScope(root, p.url)) {
+				_ = os.RemoveAll(pageDir)
+				continue
+			}
+			seen[p.url.String()] = true
+		}
+		if len(pages) == 0 {
+			root = p.url
+		}
+		if !s.Readable && s.Index == nil && p.depth >= c.Depth {
+			pages = append(pages, p)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(pageDir, "index.html"))
+		if err != nil {
+			return nil, errors.Wrap(err, "read index file failed")
+		}
+		if s.Readable || s.Index != nil {
+			if a, err := readable(content, p.url); err == nil {
+				if s.Readable {
+					if err := writeArticle(pageDir, a); err != nil {
+						return nil, err
+					}
+				}
+				p.title, p.text = a.title, a.text()
+			}
+		}
+		pages = append(pages, p)
+
+		if p.depth >= c.Depth {
+			continue
+		}
+		for _, u := range links(p.url, content) {
+			if seen[u.String()] || !c.inScope(root, u) {
+				continue
+			}
+			seen[u.String()] = true
+			queue = append(queue, &page{url: u, depth: p.depth + 1})
+		}
+	}
+
+	return pages, nil
+}
+
+// archivePage archives the page of u into dir within the timeout of the crawl, and
+// returns the URL it ends up at.
+func (s *Shaft) archivePage(ctx context.Context, c Crawl, u *url.URL, dir string) (*url.URL, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	final, _, err := s.archive(ctx, u.String(), nil, dir)
+	return final, err
+}
+
+// links returns the distinct URLs of the anchors of the webpage, without fragment.
+func links(base *url.URL, content []byte) (urls []*url.URL) {
+	doc, err := nethtml.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range dom.GetElementsByTagName(doc, "a") {
+		u, err := base.Parse(strings.TrimSpace(dom.GetAttribute(a, "href")))
+		if err != nil {
+			continue
+		}
+		u = withoutFragment(u)
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// relink rewrites the anchors of the page that point to other archived pages.
+func relink(dir string, p *page, archived map[string]*page) error {
+	file := filepath.Join(dir, filepath.FromSlash(p.dir), "index.html")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	doc, err := nethtml.Parse(bytes.NewReader(content))
+	if err != nil {
+		// Not a webpage, nothing to rewrite.
+		return nil
+	}
+
+	changed := false
+	for _, a := range dom.GetElementsByTagName(doc, "a") {
+		u, err := p.url.Parse(strings.TrimSpace(dom.GetAttribute(a, "href")))
+		if err != nil {
+			continue
+		}
+		target, ok := archived[withoutFragment(u).String()]
+		if !ok {
+			continue
+		}
+		href := "../" + target.dir + "/index.html"
+		if u.Fragment != "" {
+			href += "#" + u.EscapedFragment()
+		}
+		dom.SetAttribute(a, "href", href)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	return ioutil.WriteFile(file, []byte(dom.OuterHTML(doc)), 0600)
+}
+
+// writeSiteIndex creates the index of the snapshot, which redirects to the seed page
+// and lists all of the archived pages.
+func writeSiteIndex(dir string, pages []*page) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<meta http-equiv=\"refresh\" content=\"0; url=%s/index.html\">\n", html.EscapeString(pages[0].dir))
+	fmt.Fprintf(&b, "<title>%s</title>\n</head>\n<body>\n<ul>\n", html.EscapeString(pages[0].url.String()))
+	for _, p := range pages {
+		fmt.Fprintf(&b, "<li><a href=\"%s/index.html\">%s</a></li>\n", html.EscapeString(p.dir), html.EscapeString(p.url.String()))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(b.String()), 0600); err != nil {
+		return errors.Wrap(err, "create index file failed")
+	}
+	return nil
+}
+
+// pageDir returns a distinct directory name for the page of the given URL,
+// names holds the names that have been taken.
+func pageDir(seed, u *url.URL, names map[string]bool) string {
+	name := sanitize.BaseName(strings.Trim(u.Path, "/"))
+	if u.RawQuery != "" {
+		name = strings.Trim(name+"-"+sanitize.BaseName(u.RawQuery), "-")
+	}
+	if !strings.EqualFold(u.Host, seed.Host) {
+		name = strings.Trim(sanitize.BaseName(u.Host)+"-"+name, "-")
+	}
+	if name == "" {
+		name = "index"
+	}
+	if len(name) > 200 {
+		name = name[:200]
+	}
+
+	dir := name
+	for i := 2; names[dir]; i++ {
+		dir = fmt.Sprintf("%s-%d", name, i)
+	}
+	names[dir] = true
+
+	return dir
+}
+
+func withoutFragment(u *url.URL) *url.URL {
+	v := *u
+	v.Fragment = ""
+	v.RawFragment = ""
+	return &v
+}
@@ -0,0 +1,12 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd
+
+package rivet
+
+// freeSpace is not supported on this platform, the free disk space is not checked.
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpace
+}
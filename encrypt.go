@@ -0,0 +1,204 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/wabarc/rivet/ipfs"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+// EncryptedFile is the name of the encrypted snapshot in the pinned
+// directory if Shaft.Recipients is set. It is a tar archive of the
+// snapshot encrypted with age, see https://age-encryption.org.
+const EncryptedFile = "snapshot.tar.age"
+
+// encrypt archives the snapshot directory dir into a tar file encrypted to the recipients,
+// and returns the temporary directory in work holding it, which the caller must remove.
+func encrypt(ctx context.Context, work, dir string, recipients []age.Recipient) (_ string, err error) {
+	enc, err := mkdir(ctx, work, "encrypted")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			cleanup(ctx, enc)
+		}
+	}()
+
+	f, err := os.OpenFile(filepath.Join(enc, EncryptedFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "create encrypted file failed")
+	}
+	defer f.Close()
+
+	// The encrypted copy of the snapshot takes as much room again in WorkDir.
+	w, err := age.Encrypt(&budgetWriter{Writer: f, budget: budgetFrom(ctx)}, recipients...)
+	if err != nil {
+		return "", errors.Wrap(err, "encrypt snapshot failed")
+	}
+	if err := archiveDir(w, dir); err != nil {
+		return "", errors.Wrap(err, "encrypt snapshot failed")
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "encrypt snapshot failed")
+	}
+	if err := f.Close(); err != nil {
+		return "", errors.Wrap(err, "create encrypted file failed")
+	}
+	logger(ctx).Debug("snapshot encrypted", "dir", enc, "recipients", len(recipients))
+
+	return enc, nil
+}
+
+// archiveDir writes the files of dir to w as a tar archive. Hidden files are
+// not included, just like they are not pinned.
+func archiveDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		// Leaves out the owner of the files.
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Decrypt fetches the encrypted snapshot with the given content-id through f, decrypts
+// it with the identities and restores its files into dir, which is created if needed.
+func Decrypt(ctx context.Context, f ipfs.Fetcher, root string, identities []age.Identity, dir string) error {
+	file, err := childCID(ctx, f, root, EncryptedFile)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ipfs.Cat(ctx, f, file, pw))
+	}()
+	defer pr.Close()
+
+	r, err := age.Decrypt(pr, identities...)
+	if err != nil {
+		return errors.Wrap(err, "decrypt snapshot failed")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "create directory failed")
+	}
+	return extract(tar.NewReader(r), dir)
+}
+
+// childCID returns the content-id of the file of the given name in the directory root.
+func childCID(ctx context.Context, f ipfs.Fetcher, root, name string) (string, error) {
+	b, err := f.Block(ctx, root)
+	if err != nil {
+		return "", err
+	}
+	n, err := unixfs.Decode(b)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range n.Links {
+		if l.Name == name {
+			return l.Cid.String(), nil
+		}
+	}
+	return "", errors.Errorf("no %s found in %s, the snapshot is not encrypted", name, root)
+}
+
+// extract restores the files of the tar archive into dir, refusing to overwrite any.
+func extract(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "decrypt snapshot failed")
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("invalid path in snapshot: %s", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return errors.Wrap(err, "create directory failed")
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return errors.Wrap(err, "create directory failed")
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return errors.Wrap(err, "create file failed")
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return errors.Wrap(err, "decrypt snapshot failed")
+			}
+			if err := out.Close(); err != nil {
+				return errors.Wrap(err, "create file failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFeedSize is the maximum size of a sitemap or feed after decompression.
+	maxFeedSize = 50 << 20
+	// maxSitemapDepth is the maximum nesting of sitemap index files.
+	maxSitemapDepth = 3
+)
+
+// entry is a link listed by a sitemap or feed.
+type entry struct {
+	Loc  string `xml:"loc"`
+	GUID string `xml:"guid"`
+
+	// RSS links carry the URL as text, Atom links in an attribute.
+	Links []struct {
+		Text string `xml:",chardata"`
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+
+	LastMod   string `xml:"lastmod"`
+	NewsDate  string `xml:"news>publication_date"`
+	PubDate   string `xml:"pubDate"`
+	Date      string `xml:"date"`
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+}
+
+// document holds the elements of sitemaps, sitemap indexes, RSS and Atom feeds.
+type document struct {
+	XMLName  xml.Name
+	URLs     []entry `xml:"url"`
+	Sitemaps []entry `xml:"sitemap"`
+	Items    []entry `xml:"item"`         // RSS 1.0
+	Channel  []entry `xml:"channel>item"` // RSS 2.0
+	Entries  []entry `xml:"entry"`        // Atom
+}
+
+// Expand fetches the sitemap, sitemap index, RSS or Atom feed at source and returns the
+// URLs it lists, following sitemap indexes and decompressing gzipped sitemaps. If since or
+// until is not zero, the entries dated out of that range are left out; entries without a
+// date are always kept.
+func (s *Shaft) Expand(ctx context.Context, source *url.URL, since, until time.Time) ([]*url.URL, error) {
+	x := &expander{client: s.client(), since: since, until: until, seen: make(map[string]bool)}
+	if err := x.expand(ctx, source, 0); err != nil {
+		return nil, err
+	}
+	return x.urls, nil
+}
+
+type expander struct {
+	client *http.Client
+	since  time.Time
+	until  time.Time
+
+	seen map[string]bool
+	urls []*url.URL
+}
+
+func (x *expander) expand(ctx context.Context, source *url.URL, depth int) error {
+	doc, err := x.fetch(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	switch doc.XMLName.Local {
+	case "sitemapindex":
+		if depth >= maxSitemapDepth {
+			return errors.Errorf("sitemap index nested too deeply: %s", source)
+		}
+		for _, e := range doc.Sitemaps {
+			u, err := source.Parse(strings.TrimSpace(e.Loc))
+			if err != nil || x.seen[u.String()] || !x.changedSince(e.LastMod) {
+				continue
+			}
+			x.seen[u.String()] = true
+			if err := x.expand(ctx, u, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "urlset", "rss", "RDF", "feed":
+	default:
+		return errors.Errorf("not a sitemap or feed: %s", source)
+	}
+
+	entries := append(append(append(doc.URLs, doc.Items...), doc.Channel...), doc.Entries...)
+	for _, e := range entries {
+		if !x.within(e.LastMod, e.NewsDate, e.PubDate, e.Date, e.Published, e.Updated) {
+			continue
+		}
+		u, err := source.Parse(e.location())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || x.seen[u.String()] {
+			continue
+		}
+		x.seen[u.String()] = true
+		x.urls = append(x.urls, u)
+	}
+	return nil
+}
+
+func (x *expander) fetch(ctx context.Context, source *url.URL) (*document, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch feed failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch feed failed with status code: %d", resp.StatusCode)
+	}
+
+	var r io.Reader = bufio.NewReader(resp.Body)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "decompress feed failed")
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var doc document
+	dec := xml.NewDecoder(io.LimitReader(r, maxFeedSize))
+	dec.Strict = false
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "parse feed failed")
+	}
+	return &doc, nil
+}
+
+// within reports whether the first valid date is in the range of the expander,
+// it returns true if there is no valid date.
+func (x *expander) within(dates ...string) bool {
+	for _, d := range dates {
+		t, ok := parseDate(d)
+		if !ok {
+			continue
+		}
+		return (x.since.IsZero() || !t.Before(x.since)) && (x.until.IsZero() || !t.After(x.until))
+	}
+	return true
+}
+
+// changedSince reports whether the sitemap last modified at the given date may list entries
+// in the range, i.e. unless it is unchanged since then. Until does not apply, as a sitemap
+// modified later may still list older entries.
+func (x *expander) changedSince(lastMod string) bool {
+	t, ok := parseDate(lastMod)
+	return !ok || x.since.IsZero() || !t.Before(x.since)
+}
+
+// location returns the URL of the entry.
+func (e entry) location() string {
+	if loc := strings.TrimSpace(e.Loc); loc != "" {
+		return loc
+	}
+	for _, l := range e.Links {
+		if l.Href != "" && (l.Rel == "" || l.Rel == "alternate") {
+			return strings.TrimSpace(l.Href)
+		}
+		if text := strings.TrimSpace(l.Text); text != "" {
+			return text
+		}
+	}
+	return strings.TrimSpace(e.GUID)
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBlocked is returned when a capture would connect to an address blocked by Guard.
+var ErrBlocked = errors.New("blocked address")
+
+// BlockedRanges are the address ranges blocked by Guard: the unspecified, loopback,
+// link-local, private, shared, documentation, multicast and reserved ones.
+var BlockedRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Guard blocks the connections of the captures to private and internal networks, so
+// that the URLs given by others cannot reach them, see Shaft.Guard. The address is
+// checked once resolved, when connecting, which covers redirects and DNS rebinding.
+// Through a proxy, which resolves the host names itself, only the URLs holding an
+// address or localhost are checked.
+type Guard struct {
+	// Block holds the address ranges blocked besides BlockedRanges.
+	Block []netip.Prefix
+
+	// Allow holds the address ranges allowed even if blocked, e.g. an intranet to archive.
+	Allow []netip.Prefix
+}
+
+// Check returns an error wrapping ErrBlocked if the address is blocked. The IPv4 addresses
+// embedded by the IPv4-mapped, NAT64 and 6to4 addresses are checked as well.
+func (g *Guard) Check(addr netip.Addr) error {
+	addr = addr.WithZone("").Unmap()
+	if g.allowed(addr) {
+		return nil
+	}
+	for _, ranges := range [][]netip.Prefix{BlockedRanges, g.Block} {
+		for _, p := range ranges {
+			if p.Contains(addr) {
+				return errors.Wrapf(ErrBlocked, "connect to %s in %s", addr, p)
+			}
+		}
+	}
+	if v4, ok := embedded(addr); ok {
+		return g.Check(v4)
+	}
+	return nil
+}
+
+func (g *Guard) allowed(addr netip.Addr) bool {
+	for _, p := range g.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	nat64  = netip.MustParsePrefix("64:ff9b::/96")
+	sixTo4 = netip.MustParsePrefix("2002::/16")
+)
+
+// embedded returns the IPv4 address embedded by a NAT64 or 6to4 address.
+func embedded(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}), true
+	case sixTo4.Contains(addr):
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), true
+	}
+	return netip.Addr{}, false
+}
+
+// checkHost checks the host of a URL without resolving it, only addresses and localhost are blocked.
+func (g *Guard) checkHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return g.Check(netip.IPv6Loopback())
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.Check(addr)
+	}
+	return nil
+}
+
+// control checks the address being connected to, see net.Dialer.Control.
+func (g *Guard) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return errors.Wrapf(ErrBlocked, "connect to %s", address)
+	}
+	return g.Check(ap.Addr())
+}
+
+// checkConn checks the address of the connection made by a custom TLS dialer.
+func (g *Guard) checkConn(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := g.control("", conn.RemoteAddr().String(), nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// transport returns a copy of the base transport whose connections are checked before
+// connecting, its dialer is replaced. It fails every request if the base transport is
+// not an *http.Transport, which cannot be checked.
+//
+// The connections to the proxy are not checked, it is trusted, but only those made for
+// the requests sent through it: the proxy is marked in their context. A request the
+// proxy is bypassed for, e.g. by NO_PROXY, is checked even if it targets the proxy.
+func (g *Guard) transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return failingTransport{errors.Wrap(ErrBlocked, "guard requires the transport of the client to be an *http.Transport")}
+	}
+	t = t.Clone()
+
+	proxy := t.Proxy
+	if proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if err != nil || u == nil {
+				return u, err
+			}
+			if err := g.checkHost(req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return u, nil
+		}
+	}
+
+	var (
+		direct  = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		checked = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: g.control}
+	)
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if toProxy(ctx, addr) {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+	if dialTLS := t.DialTLSContext; dialTLS != nil {
+		t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if toProxy(ctx, addr) {
+				return dialTLS(ctx, network, addr)
+			}
+			return g.checkConn(dialTLS(ctx, network, addr))
+		}
+	}
+	// The deprecated dialers would take precedence over the checked ones.
+	t.Dial, t.DialTLS = nil, nil
+
+	if proxy == nil {
+		return t
+	}
+	return &proxiedTransport{Transport: t, proxy: proxy}
+}
+
+type ctxKeyProxy struct{}
+
+// toProxy reports whether the connection to addr is made to the proxy of the request
+// whose context is ctx, see proxiedTransport.
+func toProxy(ctx context.Context, addr string) bool {
+	p, _ := ctx.Value(ctxKeyProxy{}).(string)
+	return p != "" && p == addr
+}
+
+// proxiedTransport marks the address of the proxy in the context of the requests sent
+// through it, for the connections made for them. The connections are pooled by proxy,
+// so the ones to the proxy are never reused by the requests that bypass it.
+type proxiedTransport struct {
+	*http.Transport
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (t *proxiedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u, err := t.proxy(req); err == nil && u != nil {
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyProxy{}, proxyAddr(u)))
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// proxyAddr returns the address the transport connects to for the proxy.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// failingTransport fails every request with err.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+// guarded returns the transport of Client guarded by Guard, or as is if Guard is not set.
+// The guarded transport is kept, so that its connections are reused.
+func (s *Shaft) guarded() http.RoundTripper {
+	var base http.RoundTripper
+	if s.Client != nil {
+		base = s.Client.Transport
+	}
+	if s.Guard == nil {
+		return base
+	}
+	s.guardOnce.Do(func() {
+		s.guardTransport = s.Guard.transport(base)
+	})
+	return s.guardTransport
+}
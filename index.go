@@ -0,0 +1,259 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// The parameters of the BM25 ranking of the search results.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// excerptLength is the maximum length in runes of the excerpts of the indexed snapshots.
+const excerptLength = 200
+
+// Index is a local full-text index of the snapshots, kept as a file of JSON lines
+// to which every snapshot is appended, see Shaft.Index. It records the terms of the
+// readable text of the snapshots, their title and an excerpt of the text, so the
+// snapshots encrypted for Shaft.Recipients are not added to it.
+type Index struct {
+	// Path is the file of the index, created if needed.
+	Path string
+
+	mu sync.Mutex
+}
+
+// Document describes an indexed snapshot.
+type Document struct {
+	URL      string    `json:"url"`
+	Captured time.Time `json:"captured"`
+
+	// CID is the content-id of the snapshot if pinned.
+	CID string `json:"cid,omitempty"`
+	// Dest is the destination of the snapshot, see Shaft.Wayback. It links to
+	// the page within the snapshot of a crawl.
+	Dest string `json:"dest"`
+
+	Title   string `json:"title,omitempty"`
+	Excerpt string `json:"excerpt,omitempty"`
+}
+
+// Hit is a snapshot matching a search.
+type Hit struct {
+	Document
+
+	// Gateways are links to the snapshot on public IPFS gateways, if pinned.
+	Gateways []string `json:"gateways,omitempty"`
+	Score    float64  `json:"score"`
+}
+
+// indexEntry is a line of the index file.
+type indexEntry struct {
+	Document
+	Length int            `json:"length"`
+	Terms  map[string]int `json:"terms"`
+}
+
+// Add indexes the snapshot described by doc, whose title is indexed along with the text.
+// The content-id is taken from the destination if not given.
+func (x *Index) Add(doc Document, text string) error {
+	if cid := strings.TrimPrefix(doc.Dest, gateway); doc.CID == "" && cid != doc.Dest {
+		doc.CID, _, _ = strings.Cut(cid, "/")
+	}
+	terms := make(map[string]int)
+	length := 0
+	for _, t := range tokenize(doc.Title + "\n" + text) {
+		terms[t]++
+		length++
+	}
+	if doc.Excerpt == "" {
+		doc.Excerpt = excerpt(text)
+	}
+
+	line, err := json.Marshal(indexEntry{Document: doc, Length: length, Terms: terms})
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	f, err := os.OpenFile(x.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open index failed")
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write index failed")
+	}
+	return f.Close()
+}
+
+// Search returns the snapshots matching any of the terms of the query, the most
+// relevant first as ranked by BM25. It returns at most limit hits if limit is positive.
+func (x *Index) Search(ctx context.Context, query string, limit int) ([]Hit, error) {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil, errors.New("query is empty")
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	f, err := os.Open(x.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open index failed")
+	}
+	defer f.Close()
+
+	// Only the matching snapshots are kept, along with the statistics of all of them.
+	type candidate struct {
+		entry indexEntry
+		freqs []int
+	}
+	var (
+		candidates []candidate
+		count      int
+		total      int
+		df         = make([]int, len(terms))
+	)
+	r := bufio.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line, err := r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var e indexEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, errors.Wrap(err, "parse index failed")
+			}
+			count++
+			total += e.Length
+
+			c := candidate{freqs: make([]int, len(terms))}
+			matched := false
+			for i, t := range terms {
+				if n := e.Terms[t]; n > 0 {
+					c.freqs[i] = n
+					df[i]++
+					matched = true
+				}
+			}
+			if matched {
+				e.Terms = nil
+				c.entry = e
+				candidates = append(candidates, c)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	avg := float64(total) / float64(count)
+	hits := make([]Hit, 0, len(candidates))
+	for _, c := range candidates {
+		var score float64
+		for i, tf := range c.freqs {
+			if tf == 0 {
+				continue
+			}
+			idf := math.Log(1 + (float64(count)-float64(df[i])+0.5)/(float64(df[i])+0.5))
+			norm := float64(tf) + bm25K1*(1-bm25B+bm25B*float64(c.entry.Length)/avg)
+			score += idf * float64(tf) * (bm25K1 + 1) / norm
+		}
+		hit := Hit{Document: c.entry.Document, Score: score}
+		if hit.CID != "" {
+			hit.Gateways = gatewayLinks(hit.CID)
+		}
+		hits = append(hits, hit)
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Captured.After(hits[j].Captured)
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// tokenize splits the text into lowercase terms of letters and digits. The letters
+// of scripts written without spaces, such as Chinese, are terms on their own.
+func tokenize(text string) []string {
+	var (
+		terms []string
+		term  []rune
+	)
+	flush := func() {
+		if len(term) > 0 {
+			terms = append(terms, string(term))
+			term = term[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai):
+			flush()
+			terms = append(terms, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			term = append(term, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// excerpt returns the beginning of the text, with the whitespace collapsed.
+func excerpt(text string) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= excerptLength {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:excerptLength])) + "…"
+}
+
+// index adds the snapshot described by doc to Index, if set. Failing to index
+// a snapshot does not fail archiving it, since it is stored already.
+func (s *Shaft) index(ctx context.Context, doc Document, text string) {
+	if s.Index == nil || text == "" {
+		return
+	}
+	// The index would disclose the content of the encrypted snapshots.
+	if len(s.Recipients) > 0 && !s.ArchiveOnly {
+		logger(ctx).Debug("encrypted snapshot not indexed", "dest", doc.Dest)
+		return
+	}
+	if err := s.Index.Add(doc, text); err != nil {
+		logger(ctx).Error("index failed", "error", err)
+		if s.Metrics != nil {
+			s.Metrics.ObserveError("index")
+		}
+		return
+	}
+	logger(ctx).Debug("indexed", "dest", doc.Dest)
+}
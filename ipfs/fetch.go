@@ -0,0 +1,99 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGateway is the public gateway used when no other is configured.
+const DefaultGateway = "https://ipfs.io"
+
+// maxBlockSize is the largest block accepted from a node, which is larger than
+// any block produced by IPFS implementations.
+const maxBlockSize = 4 << 20
+
+var _ Fetcher = (*Gateway)(nil)
+var _ Fetcher = (*Locally)(nil)
+
+// Fetcher is an interface that wraps the Block method.
+type Fetcher interface {
+	// Block retrieves the raw block of the given content-id without verifying it.
+	Block(ctx context.Context, cid string) ([]byte, error)
+}
+
+// Gateway retrieves blocks from an IPFS HTTP gateway that supports
+// trustless requests, e.g. https://ipfs.io.
+type Gateway struct {
+	// URL of the gateway, defaults to DefaultGateway.
+	URL string
+
+	// Client represents a http client.
+	Client *http.Client
+}
+
+// Block retrieves the raw block of the given content-id through the gateway.
+func (g *Gateway) Block(ctx context.Context, cid string) ([]byte, error) {
+	base := g.URL
+	if base == "" {
+		base = DefaultGateway
+	}
+	endpoint := strings.TrimRight(base, "/") + "/ipfs/" + cid + "?format=raw"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch block failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch block failed with status code: %d", resp.StatusCode)
+	}
+
+	return readBlock(resp.Body)
+}
+
+// Block retrieves the raw block of the given content-id from the local IPFS node.
+func (l *Locally) Block(ctx context.Context, cid string) ([]byte, error) {
+	resp, err := l.shell.Request("block/get", cid).Send(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get block from IPFS failed")
+	}
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, errors.Wrap(resp.Error, "get block from IPFS failed")
+	}
+
+	return readBlock(resp.Output)
+}
+
+func readBlock(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBlockSize {
+		return nil, errors.New("block too large")
+	}
+	return b, nil
+}
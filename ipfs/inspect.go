@@ -0,0 +1,187 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+// Entry describes a file found in a DAG.
+type Entry struct {
+	// Path is the slash-separated path of the file relative to the root,
+	// it is empty if the root is the file itself.
+	Path string
+	CID  string
+	Size int64
+
+	// SHA256 is the hex-encoded digest of the file content, it is
+	// empty if any block of the file is missing or corrupt.
+	SHA256 string
+}
+
+// Report is the outcome of inspecting a DAG.
+type Report struct {
+	Root   string
+	Blocks int // number of blocks fetched and verified
+	Files  []Entry
+
+	Missing []string // content-ids of blocks that could not be fetched
+	Corrupt []string // content-ids of blocks that do not match their content-id
+}
+
+// OK reports whether every block of the DAG has been fetched and verified.
+func (r *Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Inspect walks the UnixFS DAG of the given content-id, fetching every block through f.
+// It verifies each block against its content-id and recomputes the digest of every file.
+// Missing and corrupt blocks are collected in the report instead of being returned as error.
+func Inspect(ctx context.Context, f Fetcher, root string) (*Report, error) {
+	c, err := cid.Decode(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cid")
+	}
+
+	in := &inspector{ctx: ctx, fetcher: f, report: &Report{Root: root}}
+	if err := in.walk(c, ""); err != nil {
+		return nil, err
+	}
+	return in.report, nil
+}
+
+// Cat writes the content of the UnixFS file with the given content-id to w, fetching every
+// block through f. Unlike Inspect, it fails if any block is missing or corrupt.
+func Cat(ctx context.Context, f Fetcher, file string, w io.Writer) error {
+	c, err := cid.Decode(file)
+	if err != nil {
+		return errors.Wrap(err, "invalid cid")
+	}
+
+	in := &inspector{ctx: ctx, fetcher: f, report: &Report{Root: file}}
+	n, err := in.node(c)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		if n.Type != unixfs.File && n.Type != unixfs.Raw {
+			return errors.Errorf("not a file: %s", file)
+		}
+		if _, err = in.read(n, w); err != nil {
+			return err
+		}
+	}
+	if !in.report.OK() {
+		return errors.Errorf("missing or corrupt blocks: %v", append(in.report.Missing, in.report.Corrupt...))
+	}
+	return nil
+}
+
+type inspector struct {
+	ctx     context.Context
+	fetcher Fetcher
+	report  *Report
+}
+
+func (in *inspector) walk(c cid.Cid, name string) error {
+	n, err := in.node(c)
+	if err != nil || n == nil {
+		return err
+	}
+
+	switch n.Type {
+	case unixfs.Directory:
+		for _, l := range n.Links {
+			if err := in.walk(l.Cid, path.Join(name, l.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case unixfs.File, unixfs.Raw:
+		h := sha256.New()
+		ok, err := in.read(n, h)
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: name, CID: c.String(), Size: int64(n.FileSize)}
+		if ok {
+			e.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		in.report.Files = append(in.report.Files, e)
+		return nil
+	default:
+		return errors.Errorf("unsupported node type %d: %s", n.Type, c)
+	}
+}
+
+// read writes the content of the file node n to w, it reports
+// whether all of the blocks of the file have been verified.
+func (in *inspector) read(n *unixfs.Node, w io.Writer) (bool, error) {
+	if _, err := w.Write(n.Data); err != nil {
+		return false, err
+	}
+
+	complete := true
+	for _, l := range n.Links {
+		child, err := in.node(l.Cid)
+		if err != nil {
+			return false, err
+		}
+		if child == nil {
+			complete = false
+			continue
+		}
+		ok, err := in.read(child, w)
+		if err != nil {
+			return false, err
+		}
+		complete = complete && ok
+	}
+	return complete, nil
+}
+
+// node fetches, verifies and decodes the block of the given content-id. It returns
+// a nil node without error if the block is missing or corrupt.
+func (in *inspector) node(c cid.Cid) (*unixfs.Node, error) {
+	if err := in.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b, err := in.fetcher.Block(in.ctx, c.String())
+	if err != nil {
+		if in.ctx.Err() != nil {
+			return nil, in.ctx.Err()
+		}
+		in.report.Missing = append(in.report.Missing, c.String())
+		return nil, nil
+	}
+	if sum, err := c.Prefix().Sum(b); err != nil || !sum.Equals(c) {
+		in.report.Corrupt = append(in.report.Corrupt, c.String())
+		return nil, nil
+	}
+	in.report.Blocks++
+
+	switch c.Type() {
+	case cid.Raw:
+		return &unixfs.Node{Type: unixfs.Raw, Data: b, FileSize: uint64(len(b))}, nil
+	case cid.DagProtobuf:
+		n, err := unixfs.Decode(b)
+		if err != nil {
+			in.report.Corrupt = append(in.report.Corrupt, c.String())
+			return nil, nil
+		}
+		return n, nil
+	default:
+		return nil, errors.Errorf("unsupported codec: %s", c)
+	}
+}
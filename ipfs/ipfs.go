@@ -6,6 +6,8 @@ package ipfs
 
 import (
 	"bytes"
+	"context"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -70,16 +72,44 @@ type Pinning struct {
 	Apikey string
 	Secret string
 
-	// Client represents a http client.
+	// Client represents a http client, for both the pinning services
+	// and the daemon server.
 	Client *http.Client
 
 	// Whether or not to use backoff stragty.
 	backoff bool
+
+	// Metrics observes the pins, optional.
+	Metrics Metrics
+
+	// Logger receives the events of every pin attempt, optional.
+	Logger *slog.Logger
+}
+
+// Metrics is an interface for observing the pins, such as an exporter of metrics.
+type Metrics interface {
+	// ObservePin records the duration of pinning to the target, see Pinning.Target,
+	// and the error if the pin failed.
+	ObservePin(target string, d time.Duration, err error)
+
+	// ObserveRetry records a retry of pinning to the target.
+	ObserveRetry(target string)
+}
+
+// Target returns the name of the pinning service, which is the
+// name of the pinner, or local for the daemon server.
+func (p *Pinning) Target() string {
+	if p.Mode == Local {
+		return "local"
+	}
+	return p.Pinner
 }
 
 // Pin implements putting the data to local IPFS node by given buf. It
 // returns content-id and an error.
 func (l *Locally) Pin(buf []byte) (cid string, err error) {
+	defer l.observe(time.Now(), &err)
+
 	action := func() error {
 		cid, err = l.shell.Add(bytes.NewReader(buf), shell.Pin(true))
 		return err
@@ -94,6 +124,8 @@ func (l *Locally) Pin(buf []byte) (cid string, err error) {
 // Pin implements putting the data to local IPFS node by given buf. It
 // returns content-id and an error.
 func (l *Locally) PinDir(path string) (cid string, err error) {
+	defer l.observe(time.Now(), &err)
+
 	action := func() error {
 		cid, err = l.shell.AddDir(path)
 		return err
@@ -108,6 +140,8 @@ func (l *Locally) PinDir(path string) (cid string, err error) {
 // Pin implements putting the data to destination pinning service by given buf. It
 // returns content-id and an error.
 func (r *Remotely) Pin(buf []byte) (cid string, err error) {
+	defer r.observe(time.Now(), &err)
+
 	action := func() error {
 		cid, err = r.remotely().Pin(buf)
 		return err
@@ -119,6 +153,8 @@ func (r *Remotely) Pin(buf []byte) (cid string, err error) {
 // Pin implements putting the data to destination pinning service by given buf. It
 // returns content-id and an error.
 func (r *Remotely) PinDir(path string) (cid string, err error) {
+	defer r.observe(time.Now(), &err)
+
 	action := func() error {
 		cid, err = r.remotely().Pin(path)
 		return err
@@ -136,7 +172,43 @@ func (r *Remotely) remotely() *pinner.Config {
 	}
 }
 
+// observe records the pin started at start, which failed if *err is not nil.
+func (p *Pinning) observe(start time.Time, err *error) {
+	if p.Metrics != nil {
+		p.Metrics.ObservePin(p.Target(), time.Since(start), *err)
+	}
+	if *err != nil {
+		p.logger().Error("pin failed", "error", *err)
+	}
+}
+
+func (p *Pinning) logger() *slog.Logger {
+	l := p.Logger
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	return l.With("target", p.Target())
+}
+
 func (p *Pinning) doRetry(op backoff.Operation) error {
+	log := p.logger()
+	attempts, action := 0, op
+	op = func() error {
+		if attempts++; attempts > 1 {
+			log.Info("retrying pin", "attempt", attempts)
+			if p.Metrics != nil {
+				p.Metrics.ObserveRetry(p.Target())
+			}
+		} else {
+			log.Info("pin attempt", "attempt", attempts)
+		}
+		err := action()
+		if err != nil {
+			log.Warn("pin attempt failed", "attempt", attempts, "error", err)
+		}
+		return err
+	}
+
 	if p.backoff {
 		exp := backoff.NewExponentialBackOff()
 		exp.MaxElapsedTime = maxElapsedTime
@@ -147,3 +219,10 @@ func (p *Pinning) doRetry(op backoff.Operation) error {
 
 	return op()
 }
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -1,17 +1,24 @@
 package ipfs
 
 import (
-	"fmt"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/ipfs/go-cid"
 	"github.com/wabarc/helper"
 	"github.com/wabarc/ipfs-pinner"
+	"github.com/wabarc/rivet/ipfs/ipfstest"
+	"github.com/wabarc/rivet/ipfs/unixfs"
 )
 
 var (
@@ -27,15 +34,15 @@ var (
     "PinSize": 1234,
     "Timestamp": "1979-01-01 00:00:00Z"
 }`
-	ipfsCid = "Qmaisz6NMhDB51cCvNWa1GMS7LU1pAxdF4Ld6Ft9kZEP2a"
-	addJSON = fmt.Sprintf(`{
-  "Bytes": 0,
-  "Hash": "%s",
-  "Name": "name",
-  "Size": "1B"
-}`, ipfsCid)
 )
 
+// helloCid is the known content-id of helloData, as added by ipfs with the defaults.
+const (
+	helloData = "hello world\n"
+	helloCid  = "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"
+)
+
+// handleResponse serves the API of Pinata, which the fake Kubo server does not.
 func handleResponse(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Hostname() {
 	case "api.pinata.cloud":
@@ -86,22 +93,10 @@ func handleResponse(w http.ResponseWriter, r *http.Request) {
 }
 
 func TestLocally(t *testing.T) {
-	handleResponse := func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Path {
-		case "/api/v0/add":
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = w.Write([]byte(addJSON))
-		}
-	}
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
 
-	_, mux, server := helper.MockServer()
-	mux.HandleFunc("/", handleResponse)
-	defer server.Close()
-
-	u, _ := url.Parse(server.URL)
-	host := u.Hostname()
-	port, _ := strconv.Atoi(u.Port())
+	host, port := kubo.Addr()
 	opts := []PinningOption{
 		Mode(Local),
 		Host(host),
@@ -109,13 +104,31 @@ func TestLocally(t *testing.T) {
 	}
 
 	p := Options(opts...)
-	b := []byte(helper.RandString(6, "lower"))
-	i, err := (&Locally{p}).Pin(b)
+	i, err := (&Locally{p}).Pin([]byte(helloData))
 	if err != nil {
 		t.Errorf("Unexpected pin data locally: %v", err)
 	}
-	if i != ipfsCid {
-		t.Fatalf("Unexpected cid got %s instead of %s", i, ipfsCid)
+	if i != helloCid {
+		t.Fatalf("Unexpected cid got %s instead of %s", i, helloCid)
+	}
+}
+
+func TestLocallyWithClient(t *testing.T) {
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+
+	client, mux, server := helper.MockServer()
+	mux.Handle("/", kubo.Config.Handler)
+	defer server.Close()
+
+	// The host is only reachable through the client.
+	p := Options(Mode(Local), Host("ipfs.example"), Port(5001), Client(client))
+	i, err := (&Locally{p}).Pin([]byte(helper.RandString(6, "lower")))
+	if err != nil {
+		t.Fatalf("Unexpected pin data locally: %v", err)
+	}
+	if calls := kubo.Pinner.Calls(); len(calls) != 1 || i != calls[0].CID {
+		t.Fatalf("Unexpected cid %s of pins: %+v", i, calls)
 	}
 }
 
@@ -141,6 +154,9 @@ func TestRemotely(t *testing.T) {
 }
 
 func TestRateLimit(t *testing.T) {
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+
 	counter := 0
 	handleResponse := func(w http.ResponseWriter, r *http.Request) {
 		counter++
@@ -148,12 +164,7 @@ func TestRateLimit(t *testing.T) {
 			_, _ = w.Write([]byte(``))
 			return
 		}
-		switch r.URL.Path {
-		case "/api/v0/add":
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = w.Write([]byte(addJSON))
-		}
+		kubo.Config.Handler.ServeHTTP(w, r)
 	}
 
 	_, mux, server := helper.MockServer()
@@ -171,12 +182,68 @@ func TestRateLimit(t *testing.T) {
 	}
 
 	p := Options(opts...)
-	b := []byte(helper.RandString(6, "lower"))
-	i, err := (&Locally{p}).Pin(b)
+	i, err := (&Locally{p}).Pin([]byte(helloData))
 	if err != nil {
 		t.Errorf("Unexpected pin data locally: %v", err)
 	}
-	if i != ipfsCid {
-		t.Fatalf("Unexpected cid got %s instead of %s", i, ipfsCid)
+	if i != helloCid {
+		t.Fatalf("Unexpected cid got %s instead of %s", i, helloCid)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte(helper.RandString(unixfs.ChunkSize+1024, "lower"))
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := make(map[string][]byte)
+	root, err := unixfs.AddDir(dir, func(c cid.Cid, b []byte) error {
+		blocks[c.String()] = b
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirNode, _ := unixfs.Decode(blocks[root.Cid.String()])
+	fileNode, _ := unixfs.Decode(blocks[dirNode.Links[0].Cid.String()])
+
+	handleResponse := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "raw" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, ok := blocks[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(b)
+	}
+	_, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	gw := &Gateway{URL: server.URL}
+	report, err := Inspect(context.Background(), gw, root.Cid.String())
+	if err != nil {
+		t.Fatalf("Unexpected inspect: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if !report.OK() || len(report.Files) != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if f := report.Files[0]; f.Path != "index.html" || f.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Unexpected file: %+v", f)
+	}
+
+	delete(blocks, fileNode.Links[1].Cid.String())
+	report, err = Inspect(context.Background(), gw, root.Cid.String())
+	if err != nil {
+		t.Fatalf("Unexpected inspect: %v", err)
+	}
+	if report.OK() || len(report.Missing) != 1 || report.Files[0].SHA256 != "" {
+		t.Fatalf("Unexpected report with missing block: %+v", report)
 	}
 }
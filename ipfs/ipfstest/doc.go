@@ -0,0 +1,27 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+Package ipfstest provides an in-memory pinner and a fake Kubo RPC server for
+testing the code pinning to IPFS without any network access or IPFS node. The
+content-ids are computed the way `ipfs add` does by default, so that they can
+be compared with the ones of the real services.
+
+Pinner cannot be given to rivet.Shaft directly: its Hold and Next fields are
+ipfs.Pinning configurations, not pinners. Code archiving through a Shaft pins
+to the Pinner by way of the fake Kubo server instead, in local mode:
+
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+
+	host, port := kubo.Addr()
+	shaft := &rivet.Shaft{
+		Hold: ipfs.Options(ipfs.Mode(ipfs.Local), ipfs.Host(host), ipfs.Port(port)),
+	}
+
+and then inspects kubo.Pinner.Calls and kubo.Pinner.Block. If the Shaft has a
+Client that cannot reach the server, such as one rewriting every host to a mock
+server, set ipfs.Client to another client so that it is not used for pinning.
+*/
+package ipfstest // import "github.com/wabarc/rivet/ipfs/ipfstest"
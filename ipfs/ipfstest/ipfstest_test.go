@@ -0,0 +1,139 @@
+package ipfstest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/wabarc/rivet/ipfs"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+var (
+	_ ipfs.Pinner  = (*Pinner)(nil)
+	_ ipfs.Fetcher = (*Pinner)(nil)
+)
+
+func testDir(t *testing.T) (dir, cid string) {
+	dir = filepath.Join(t.TempDir(), "snapshot")
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"index.html":      "<html>rivet</html>",
+		"assets/site.css": "body{}",
+		".hidden":         "skipped",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := unixfs.AddDir(dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected add directory: %v", err)
+	}
+	return dir, l.Cid.String()
+}
+
+func TestPinner(t *testing.T) {
+	failure := errors.New("injected")
+	p := &Pinner{Errs: []error{failure, nil}, Latency: 10 * time.Millisecond}
+
+	data := []byte("hello world\n")
+	if _, err := p.Pin(data); !errors.Is(err, failure) {
+		t.Fatalf("Unexpected pin, got %v instead of the injected error", err)
+	}
+	start := time.Now()
+	got, err := p.Pin(data)
+	if err != nil {
+		t.Fatalf("Unexpected pin: %v", err)
+	}
+	if time.Since(start) < p.Latency {
+		t.Errorf("Unexpected pin without latency")
+	}
+	// The CID of `echo "hello world" | ipfs add`.
+	if want := "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"; got != want {
+		t.Errorf("Unexpected cid of the data, got %s instead of %s", got, want)
+	}
+	b, err := p.Block(context.TODO(), got)
+	if err != nil {
+		t.Fatalf("Unexpected block: %v", err)
+	}
+	if c, _ := cid.Decode(got); !bytes.Equal(c.Hash(), mustSum(t, c, b)) {
+		t.Errorf("Unexpected block of %s", got)
+	}
+
+	dir, want := testDir(t)
+	if got, err := p.PinDir(dir); err != nil || got != want {
+		t.Errorf("Unexpected pin of the directory, got %s, %v instead of %s", got, err, want)
+	}
+	p.Err = failure
+	if _, err := p.PinDir(dir); !errors.Is(err, failure) {
+		t.Errorf("Unexpected pin, got %v instead of the injected error", err)
+	}
+
+	calls := p.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("Unexpected number of calls, got %d instead of 4", len(calls))
+	}
+	if c := calls[0]; c.Method != "Pin" || c.Size != len(data) || c.CID != "" || c.Err != failure {
+		t.Errorf("Unexpected first call: %+v", c)
+	}
+	if c := calls[2]; c.Method != "PinDir" || c.Path != dir || c.CID != want || c.Err != nil {
+		t.Errorf("Unexpected third call: %+v", c)
+	}
+	if _, err := p.Block(context.TODO(), "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected block never pinned: %v", err)
+	}
+}
+
+func mustSum(t *testing.T, c cid.Cid, b []byte) []byte {
+	sum, err := c.Prefix().Sum(b)
+	if err != nil {
+		t.Fatalf("Unexpected sum: %v", err)
+	}
+	return sum.Hash()
+}
+
+func TestKubo(t *testing.T) {
+	k := NewKubo(nil)
+	defer k.Close()
+
+	host, port := k.Addr()
+	l := &ipfs.Locally{Pinning: ipfs.Options(ipfs.Mode(ipfs.Local), ipfs.Host(host), ipfs.Port(port))}
+
+	data := []byte("hello world\n")
+	got, err := l.Pin(data)
+	if err != nil {
+		t.Fatalf("Unexpected pin data locally: %v", err)
+	}
+	if want := "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"; got != want {
+		t.Errorf("Unexpected cid of the data, got %s instead of %s", got, want)
+	}
+
+	dir, want := testDir(t)
+	got, err = l.PinDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected pin directory locally: %v", err)
+	}
+	if got != want {
+		t.Errorf("Unexpected cid of the directory, got %s instead of %s", got, want)
+	}
+	if _, err := l.Block(context.TODO(), got); err != nil {
+		t.Errorf("Unexpected block of the directory: %v", err)
+	}
+	if calls := k.Pinner.Calls(); len(calls) != 2 || calls[1].Method != "PinDir" {
+		t.Errorf("Unexpected calls: %+v", calls)
+	}
+
+	k.Pinner.Err = errors.New("injected")
+	if _, err := l.PinDir(dir); err == nil {
+		t.Error("Unexpected pin directory locally without error")
+	}
+}
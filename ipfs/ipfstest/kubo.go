@@ -0,0 +1,175 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package ipfstest
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kubo is a fake Kubo RPC server backed by a Pinner, which serves the add and
+// block/get commands used by ipfs.Locally. The data added is pinned to the Pinner,
+// the directories through a temporary copy which is removed afterwards.
+type Kubo struct {
+	*httptest.Server
+
+	// Pinner pins the data added and holds the blocks served.
+	Pinner *Pinner
+}
+
+// NewKubo starts a fake Kubo RPC server backed by p, or by a new Pinner if p
+// is nil. The caller should call Close when finished, to shut it down.
+func NewKubo(p *Pinner) *Kubo {
+	if p == nil {
+		p = &Pinner{}
+	}
+	k := &Kubo{Pinner: p}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/add", k.add)
+	mux.HandleFunc("/api/v0/block/get", k.block)
+	k.Server = httptest.NewServer(mux)
+	return k
+}
+
+// Addr returns the host and port of the server, see ipfs.Host and ipfs.Port.
+func (k *Kubo) Addr() (host string, port int) {
+	u, _ := url.Parse(k.URL)
+	port, _ = strconv.Atoi(u.Port())
+	return u.Hostname(), port
+}
+
+// add pins the file or the directory in the multipart body, and responds with
+// the content-id of its root.
+func (k *Kubo) add(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	tmp, err := os.MkdirTemp("", "ipfstest-")
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	var root string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+		// The filename is the escaped path, which FileName would trim to its base.
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name, err := url.QueryUnescape(params["filename"])
+		if err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+		isDir := part.Header.Get("Content-Type") == "application/x-directory"
+
+		// A lone file is added as is.
+		if root == "" && !isDir {
+			b, err := io.ReadAll(part)
+			if err != nil {
+				fail(w, http.StatusBadRequest, err)
+				return
+			}
+			cid, err := k.Pinner.Pin(b)
+			if err != nil {
+				fail(w, http.StatusInternalServerError, err)
+				return
+			}
+			added(w, name, cid)
+			return
+		}
+
+		rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+		if root == "" {
+			root = rel
+		}
+		if err := save(filepath.Join(tmp, filepath.FromSlash(rel)), part, isDir); err != nil {
+			fail(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if root == "" {
+		fail(w, http.StatusBadRequest, errors.New("no file given"))
+		return
+	}
+	cid, err := k.Pinner.PinDir(filepath.Join(tmp, filepath.FromSlash(root)))
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	added(w, root, cid)
+}
+
+// added responds with the content-id of the file or directory added.
+func added(w http.ResponseWriter, name, cid string) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"Name": name, "Hash": cid})
+}
+
+// save writes the part of a directory added to dst.
+func save(dst string, r io.Reader, isDir bool) error {
+	if isDir {
+		return os.MkdirAll(dst, 0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// block responds with the raw block of the content-id held by the Pinner.
+func (k *Kubo) block(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	b, err := k.Pinner.Block(r.Context(), r.URL.Query().Get("arg"))
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(b)
+}
+
+// fail responds with the error the way Kubo does.
+func fail(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Message": err.Error(), "Code": 0, "Type": "error"})
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package ipfstest
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+// ErrNotFound is returned by Pinner.Block for the blocks it does not hold.
+var ErrNotFound = errors.New("block not found")
+
+// Pinner is an in-memory ipfs.Pinner and ipfs.Fetcher. It keeps the blocks of the data
+// pinned, records every call, and fails or delays the pins as configured. It is safe
+// for concurrent use, the configuration must not be changed while pinning though.
+type Pinner struct {
+	// Latency delays every pin, e.g. to exercise timeouts.
+	Latency time.Duration
+
+	// Errs are returned by the successive pins, a nil one lets the pin succeed.
+	// The pins after them fail with Err if set, e.g. to exercise fallbacks.
+	Errs []error
+	Err  error
+
+	mu     sync.Mutex
+	pins   int
+	calls  []Call
+	blocks map[string][]byte
+}
+
+// Call is a pin made to the Pinner.
+type Call struct {
+	// Method is either Pin or PinDir.
+	Method string
+
+	// Path is the directory pinned by PinDir.
+	Path string
+
+	// Size is the length of the data pinned by Pin.
+	Size int
+
+	// CID is the content-id returned, empty if the pin failed.
+	CID string
+
+	// Err is the error returned, if any.
+	Err error
+}
+
+// Pin pins the data as a file, and returns its content-id.
+func (p *Pinner) Pin(buf []byte) (string, error) {
+	return p.pin(Call{Method: "Pin", Size: len(buf)}, func(put unixfs.PutFunc) (unixfs.Link, error) {
+		return unixfs.AddFile(bytes.NewReader(buf), put)
+	})
+}
+
+// PinDir pins the directory at path, and returns its content-id. Hidden files are
+// skipped, as the IPFS HTTP client does.
+func (p *Pinner) PinDir(path string) (string, error) {
+	return p.pin(Call{Method: "PinDir", Path: path}, func(put unixfs.PutFunc) (unixfs.Link, error) {
+		return unixfs.AddDir(path, put)
+	})
+}
+
+func (p *Pinner) pin(call Call, add func(unixfs.PutFunc) (unixfs.Link, error)) (string, error) {
+	p.mu.Lock()
+	err := p.Err
+	if p.pins < len(p.Errs) {
+		err = p.Errs[p.pins]
+	}
+	p.pins++
+	p.mu.Unlock()
+
+	if p.Latency > 0 {
+		time.Sleep(p.Latency)
+	}
+
+	blocks := make(map[string][]byte)
+	if err == nil {
+		var root unixfs.Link
+		root, err = add(func(c cid.Cid, block []byte) error {
+			blocks[c.String()] = append([]byte(nil), block...)
+			return nil
+		})
+		if err == nil {
+			call.CID = root.Cid.String()
+		}
+	}
+	call.Err = err
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, call)
+	if err != nil {
+		return "", err
+	}
+	if p.blocks == nil {
+		p.blocks = make(map[string][]byte)
+	}
+	for c, b := range blocks {
+		p.blocks[c] = b
+	}
+	return call.CID, nil
+}
+
+// Calls returns the pins made so far, in the order they completed.
+func (p *Pinner) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Call(nil), p.calls...)
+}
+
+// Block returns the block of the given content-id among the data pinned,
+// or an error wrapping ErrNotFound.
+func (p *Pinner) Block(ctx context.Context, id string) ([]byte, error) {
+	key := id
+	if c, err := cid.Decode(id); err == nil {
+		key = c.String()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.blocks[key]
+	if !ok {
+		return nil, errors.Wrap(ErrNotFound, id)
+	}
+	return append([]byte(nil), b...), nil
+}
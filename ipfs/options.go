@@ -5,6 +5,7 @@
 package ipfs
 
 import (
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
@@ -67,22 +68,47 @@ func Backoff(b bool) PinningOption {
 	}
 }
 
-// Client sets the Client field of a Pinning struct to the given http.Client instance.
+// Client sets the Client field of a Pinning struct to the given http.Client instance,
+// which is used by both the remote pinning services and the local IPFS node.
 func Client(c *http.Client) PinningOption {
 	return func(o *Pinning) {
 		o.Client = c
 	}
 }
 
+// Observe sets the Metrics field of a Pinning struct to the given metrics.
+func Observe(m Metrics) PinningOption {
+	return func(o *Pinning) {
+		o.Metrics = m
+	}
+}
+
+// Logger sets the Logger field of a Pinning struct to the given logger.
+func Logger(l *slog.Logger) PinningOption {
+	return func(o *Pinning) {
+		o.Logger = l
+	}
+}
+
 // Options takes one or more PinningOptions and returns a Pinning struct has been configured
 // according to those options.
 func Options(options ...PinningOption) Pinning {
 	var p Pinning
+	return p.With(options...)
+}
+
+// With returns a copy of the Pinning struct with the given options applied.
+func (p Pinning) With(options ...PinningOption) Pinning {
 	for _, o := range options {
 		o(&p)
 	}
 	if p.Mode == Local {
-		p.shell = shell.NewShell(net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+		addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+		if p.Client != nil {
+			p.shell = shell.NewShellWithClient(addr, p.Client)
+		} else {
+			p.shell = shell.NewShell(addr)
+		}
 	}
 	if p.Mode == Remote && p.Pinner == "" {
 		p.Pinner = pinner.Infura
@@ -0,0 +1,10 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+Package unixfs encodes and decodes the UnixFS DAGs IPFS stores files and
+directories as, which allows computing content-ids locally without any
+IPFS node and verifying the blocks fetched from one.
+*/
+package unixfs // import "github.com/wabarc/rivet/ipfs/unixfs"
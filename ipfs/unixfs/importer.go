@@ -0,0 +1,181 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package unixfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChunkSize is the size of the leaves a file is split into.
+	ChunkSize = 256 << 10
+	// LinksPerBlock is the maximum number of children of a file node.
+	LinksPerBlock = 174
+)
+
+// PutFunc is called with every block of a DAG while it is being built.
+type PutFunc func(c cid.Cid, block []byte) error
+
+// AddFile builds the DAG of the data read from r the way `ipfs add` does by
+// default, that is CIDv0, fixed-size chunks and the balanced layout. It
+// returns the link to the root node; put may be nil if the blocks are not
+// needed.
+func AddFile(r io.Reader, put PutFunc) (Link, error) {
+	b := &builder{r: r, put: put, buf: make([]byte, ChunkSize)}
+	if err := b.advance(); err != nil {
+		return Link{}, err
+	}
+
+	if b.done() {
+		return b.store(&Node{Type: File})
+	}
+
+	root, err := b.leaf()
+	if err != nil {
+		return Link{}, err
+	}
+	for depth := 1; !b.done(); depth++ {
+		n := &Node{Type: File}
+		n.add(root)
+		if root, err = b.fill(n, depth); err != nil {
+			return Link{}, err
+		}
+	}
+	return root, nil
+}
+
+// AddDir builds the DAG of the directory at path the way `ipfs add -r` does
+// by default. Hidden files are skipped, just like the IPFS HTTP client does.
+func AddDir(path string, put PutFunc) (Link, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return Link{}, err
+	}
+
+	dir := &Node{Type: Directory}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		var l Link
+		p := filepath.Join(path, e.Name())
+		switch {
+		case e.IsDir():
+			l, err = AddDir(p, put)
+		case e.Type().IsRegular():
+			l, err = addFile(p, put)
+		default:
+			err = errors.Errorf("unsupported file type: %s", p)
+		}
+		if err != nil {
+			return Link{}, err
+		}
+		l.Name = e.Name()
+		dir.Links = append(dir.Links, l)
+	}
+
+	return (&builder{put: put}).store(dir)
+}
+
+func addFile(path string, put PutFunc) (Link, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Link{}, err
+	}
+	defer f.Close()
+
+	return AddFile(f, put)
+}
+
+// builder splits data into chunks and assembles them into a balanced DAG.
+type builder struct {
+	r   io.Reader
+	put PutFunc
+
+	buf   []byte
+	chunk []byte // the next chunk, nil when no data left
+}
+
+func (b *builder) advance() error {
+	n, err := io.ReadFull(b.r, b.buf)
+	switch err {
+	case nil, io.ErrUnexpectedEOF:
+		b.chunk = append([]byte(nil), b.buf[:n]...)
+	case io.EOF:
+		b.chunk = nil
+	default:
+		return err
+	}
+	return nil
+}
+
+func (b *builder) done() bool {
+	return b.chunk == nil
+}
+
+func (b *builder) leaf() (Link, error) {
+	data := b.chunk
+	if err := b.advance(); err != nil {
+		return Link{}, err
+	}
+	return b.store(&Node{Type: File, Data: data, FileSize: uint64(len(data))})
+}
+
+// fill adds children to n until it is full or the data runs out,
+// each child being a tree of the given depth minus one.
+func (b *builder) fill(n *Node, depth int) (Link, error) {
+	for len(n.Links) < LinksPerBlock && !b.done() {
+		var (
+			child Link
+			err   error
+		)
+		if depth == 1 {
+			child, err = b.leaf()
+		} else {
+			child, err = b.fill(&Node{Type: File}, depth-1)
+		}
+		if err != nil {
+			return Link{}, err
+		}
+		n.add(child)
+	}
+	return b.store(n)
+}
+
+// store encodes the node and hands it to put, it returns an unnamed link to the node.
+func (b *builder) store(n *Node) (Link, error) {
+	block := n.Encode()
+	mh, err := multihash.Sum(block, multihash.SHA2_256, -1)
+	if err != nil {
+		return Link{}, err
+	}
+	c := cid.NewCidV0(mh)
+	if b.put != nil {
+		if err := b.put(c, block); err != nil {
+			return Link{}, err
+		}
+	}
+
+	size := uint64(len(block))
+	for _, l := range n.Links {
+		size += l.Size
+	}
+	return Link{Cid: c, Size: size, fileSize: n.FileSize}, nil
+}
+
+// add appends the child to the file node n.
+func (n *Node) add(child Link) {
+	n.Links = append(n.Links, Link{Cid: child.Cid, Size: child.Size})
+	n.BlockSizes = append(n.BlockSizes, child.fileSize)
+	n.FileSize += child.fileSize
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package unixfs
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is the type of a UnixFS node.
+type DataType uint64
+
+const (
+	Raw DataType = iota
+	Directory
+	File
+	Metadata
+	Symlink
+	HAMTShard
+)
+
+// Link is a named reference from a node to another node.
+type Link struct {
+	Name string
+	Cid  cid.Cid
+
+	// Size is the cumulative size of the referenced node and all
+	// of its descendants.
+	Size uint64
+
+	fileSize uint64 // file size of the referenced node, only known while building
+}
+
+// Node is a dag-pb node carrying UnixFS data.
+type Node struct {
+	Links []Link
+
+	Type DataType
+	Data []byte
+
+	// FileSize is the size of the file data held by the node and its children,
+	// it is only present in file and raw nodes.
+	FileSize uint64
+	// BlockSizes holds the file size of each child of a file node.
+	BlockSizes []uint64
+}
+
+// Encode returns the canonical dag-pb encoding of the node, which
+// is identical to the one produced by Kubo.
+func (n *Node) Encode() []byte {
+	var b []byte
+	for _, l := range n.Links {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendBytes(lb, l.Cid.Bytes())
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, 3, protowire.VarintType)
+		lb = protowire.AppendVarint(lb, l.Size)
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+
+	var db []byte
+	db = protowire.AppendTag(db, 1, protowire.VarintType)
+	db = protowire.AppendVarint(db, uint64(n.Type))
+	if len(n.Data) > 0 {
+		db = protowire.AppendTag(db, 2, protowire.BytesType)
+		db = protowire.AppendBytes(db, n.Data)
+	}
+	if n.Type == File || n.Type == Raw {
+		db = protowire.AppendTag(db, 3, protowire.VarintType)
+		db = protowire.AppendVarint(db, n.FileSize)
+	}
+	for _, s := range n.BlockSizes {
+		db = protowire.AppendTag(db, 4, protowire.VarintType)
+		db = protowire.AppendVarint(db, s)
+	}
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, db)
+
+	return b
+}
+
+// Decode parses a dag-pb block holding UnixFS data.
+func Decode(block []byte) (*Node, error) {
+	n := &Node{}
+	var data []byte
+	err := consume(block, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			data = v
+		case num == 2 && typ == protowire.BytesType:
+			l, err := decodeLink(v)
+			if err != nil {
+				return err
+			}
+			n.Links = append(n.Links, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decode dag-pb node failed")
+	}
+
+	err = consume(data, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			n.Type = DataType(x)
+		case num == 2 && typ == protowire.BytesType:
+			n.Data = v
+		case num == 3 && typ == protowire.VarintType:
+			n.FileSize = x
+		case num == 4 && typ == protowire.VarintType:
+			n.BlockSizes = append(n.BlockSizes, x)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decode unixfs data failed")
+	}
+
+	return n, nil
+}
+
+func decodeLink(b []byte) (l Link, err error) {
+	err = consume(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			_, c, err := cid.CidFromBytes(v)
+			if err != nil {
+				return err
+			}
+			l.Cid = c
+		case num == 2 && typ == protowire.BytesType:
+			l.Name = string(v)
+		case num == 3 && typ == protowire.VarintType:
+			l.Size = x
+		}
+		return nil
+	})
+	if err == nil && !l.Cid.Defined() {
+		err = errors.New("link without hash")
+	}
+	return l, err
+}
+
+// consume calls fn for every field of the protobuf message b, v holds the
+// payload of length-delimited fields and x the value of varint fields.
+func consume(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v []byte
+			x uint64
+		)
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package unixfs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func randBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestAddFile(t *testing.T) {
+	tests := []struct {
+		size int
+		cid  string
+	}{
+		{0, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{12, "QmbETRQNDTMdQ77oRWCgzjgFzaJv1QW7SkELV7Pc5zmAHW"},
+		{ChunkSize, "QmVv98nkCyJAb1SNUTL5CZsvzY6jCrJ1x5ckjnYuPeyHiy"},
+		{ChunkSize + 1, "QmeeBT4eBtccCKB1uNUzE5eXnX4Mr4j5ybqwaGHFThcLzp"},
+		{1 << 20, "QmTRwPZM3nsYeGMdHsTTJKnb6zDXCGvc1DJ81Z3efhzH22"},
+		{LinksPerBlock*ChunkSize + 5, "QmfSEk3kthMXCEiq8qQct2Jg5S69HwfHQSbUcpyqKs1Rhs"},
+	}
+
+	for _, test := range tests {
+		l, err := AddFile(bytes.NewReader(randBytes(test.size, 42)), nil)
+		if err != nil {
+			t.Fatalf("Unexpected add file: %v", err)
+		}
+		if l.Cid.String() != test.cid {
+			t.Errorf("Unexpected cid of %d bytes, got %s instead of %s", test.size, l.Cid, test.cid)
+		}
+	}
+}
+
+func TestAddDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"a.txt":     []byte("hello world\n"),
+		"sub/b.bin": randBytes(300000, 7),
+		".hidden":   []byte("skipped"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks := make(map[cid.Cid][]byte)
+	l, err := AddDir(dir, func(c cid.Cid, b []byte) error {
+		blocks[c] = b
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected add directory: %v", err)
+	}
+	if want := "QmT3CUf4mXdJPUspJ5NPTZaFKo4VG4SYJbyfth4nE6D2jH"; l.Cid.String() != want {
+		t.Fatalf("Unexpected cid got %s instead of %s", l.Cid, want)
+	}
+
+	n, err := Decode(blocks[l.Cid])
+	if err != nil {
+		t.Fatalf("Unexpected decode: %v", err)
+	}
+	if n.Type != Directory || len(n.Links) != 3 {
+		t.Fatalf("Unexpected root node: %+v", n)
+	}
+	names := []string{"a.txt", "empty", "sub"}
+	for i, link := range n.Links {
+		if link.Name != names[i] {
+			t.Errorf("Unexpected link name got %s instead of %s", link.Name, names[i])
+		}
+		if _, ok := blocks[link.Cid]; !ok {
+			t.Errorf("Unexpected missing block %s", link.Cid)
+		}
+	}
+	if got := n.Links[2].Cid.String(); got != "QmeLypYuRi2WBHMSv1oPALHTMFB8N6phWSf9EAnMVvH24S" {
+		t.Errorf("Unexpected cid of subdirectory: %s", got)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data := []byte("hello world\n")
+	want := &Node{Type: File, Data: data, FileSize: uint64(len(data))}
+	n, err := Decode(want.Encode())
+	if err != nil {
+		t.Fatalf("Unexpected decode: %v", err)
+	}
+	if n.Type != want.Type || !bytes.Equal(n.Data, want.Data) || n.FileSize != want.FileSize {
+		t.Fatalf("Unexpected node got %+v instead of %+v", n, want)
+	}
+
+	if _, err := Decode([]byte{0x0a, 0xff}); err == nil {
+		t.Fatal("Unexpected decode truncated block without error")
+	}
+}
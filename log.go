@@ -0,0 +1,88 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"os"
+)
+
+type (
+	ctxKeyRequestID struct{}
+	ctxKeyLogger    struct{}
+)
+
+// WithRequestID returns a copy of ctx carrying the given ID, which is attached to the log
+// events of the captures and pins made with it. Otherwise each call generates its own ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestID{}, id)
+}
+
+// RequestID returns the ID carried by ctx, see WithRequestID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID{}).(string)
+	return id
+}
+
+// begin returns a copy of ctx carrying the logger and the tracker of
+// the progress of the request for the given URL.
+func (s *Shaft) begin(ctx context.Context, u *url.URL) context.Context {
+	id := RequestID(ctx)
+	if id == "" {
+		id = newRequestID()
+		ctx = WithRequestID(ctx, id)
+	}
+	l := s.Logger
+	if l == nil {
+		l = discard
+	}
+	ctx = context.WithValue(ctx, ctxKeyLogger{}, l.With("request_id", id, "url", u.String()))
+
+	p, ok := ctx.Value(ctxKeyProgress{}).(Progress)
+	if !ok {
+		p = s.Progress
+	}
+	if p != nil {
+		ctx = context.WithValue(ctx, ctxKeyTracker{}, &tracker{url: u, progress: p})
+	}
+	return ctx
+}
+
+// logger returns the logger of the request carried by ctx, see begin.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKeyLogger{}).(*slog.Logger); ok {
+		return l
+	}
+	return discard
+}
+
+// cleanup removes the temporary directory of a snapshot.
+func cleanup(ctx context.Context, dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		logger(ctx).Warn("remove temp directory failed", "dir", dir, "error", err)
+		return
+	}
+	logger(ctx).Debug("temp directory removed", "dir", dir)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// discard is the logger used if Shaft has none.
+var discard = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
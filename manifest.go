@@ -0,0 +1,189 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wabarc/rivet/ipfs/unixfs"
+)
+
+// ManifestFile is the name of the manifest stored in every snapshot.
+const ManifestFile = "manifest.json"
+
+// The sources of the webpages, see Manifest.Source.
+const (
+	// SourceFetched is a webpage fetched from its URL by the capture.
+	SourceFetched = "fetched"
+	// SourceSubmitted is a webpage given to the capture, see Shaft.WithInput, which
+	// is not evidence of the content served at its URL.
+	SourceSubmitted = "submitted"
+)
+
+// Manifest describes a snapshot and the files it consists of.
+type Manifest struct {
+	URL      string    `json:"url"`
+	Captured time.Time `json:"captured"`
+	Files    []File    `json:"files"`
+
+	// Original is the URL as given if it differs from URL, which
+	// is its canonical form, see Shaft.Canonical.
+	Original string `json:"original,omitempty"`
+	// Title is the title of the webpage, only extracted if Shaft.Readable or Shaft.Index is set.
+	Title string `json:"title,omitempty"`
+	// Source is how the webpage was obtained, either SourceFetched or SourceSubmitted.
+	Source string `json:"source,omitempty"`
+}
+
+// File describes a file of a snapshot.
+type File struct {
+	// Path is the slash-separated path of the file relative to the snapshot.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// CID is the content-id of the file as computed by `ipfs add`.
+	CID string `json:"cid"`
+}
+
+// NewManifest describes the files of the snapshot directory dir. Hidden files are
+// not included since they are not pinned, nor are the manifest and attestation.
+func NewManifest(dir string) (*Manifest, error) {
+	m := &Manifest{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ManifestFile || rel == AttestationFile {
+			return nil
+		}
+
+		f, err := describe(path)
+		if err != nil {
+			return err
+		}
+		f.Path = rel
+		m.Files = append(m.Files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "describe snapshot failed")
+	}
+
+	return m, nil
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the paths and contents of the files,
+// which identifies the content of a snapshot regardless of its URL and capture time.
+func (m *Manifest) Digest() string {
+	files := make([]File, len(m.Files))
+	copy(files, m.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s  %s\n", f.SHA256, f.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// size returns the total size in bytes of the files.
+func (m *Manifest) size() (n int64) {
+	for _, f := range m.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// ReadManifest reads the manifest from the given file.
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(b)
+}
+
+func parseManifest(b []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "parse manifest failed")
+	}
+	return &m, nil
+}
+
+// writeManifest describes the snapshot directory dir and stores the manifest in it,
+// with the URLs, capture time, title and source of meta.
+func writeManifest(dir string, meta Manifest) (*Manifest, error) {
+	m, err := NewManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	m.URL, m.Original, m.Title, m.Source = meta.URL, meta.Original, meta.Title, meta.Source
+	m.Captured = meta.Captured.UTC()
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestFile), b, 0600); err != nil {
+		return nil, errors.Wrap(err, "create manifest failed")
+	}
+
+	return m, nil
+}
+
+func describe(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+	h := sha256.New()
+	l, err := unixfs.AddFile(io.TeeReader(f, h), nil)
+	if err != nil {
+		return File{}, err
+	}
+
+	return File{
+		Size:   fi.Size(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		CID:    l.Cid.String(),
+	}, nil
+}
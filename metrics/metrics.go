@@ -0,0 +1,232 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package metrics exports the metrics of captures and pins
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wabarc/rivet"
+	"github.com/wabarc/rivet/ipfs"
+)
+
+var (
+	_ rivet.Metrics = (*Registry)(nil)
+	_ ipfs.Metrics  = (*Registry)(nil)
+	_ http.Handler  = (*Registry)(nil)
+)
+
+var (
+	durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	sizeBuckets     = []float64{1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28}
+)
+
+// Registry collects the metrics of a Shaft and its pinning services, and serves them
+// over HTTP to Prometheus. The zero value is not usable, use New instead.
+type Registry struct {
+	mu sync.Mutex
+
+	captureDuration *histogram
+	captureSize     *histogram
+	pinDuration     map[string]*histogram // by target
+	retries         map[string]uint64     // by target
+	fallbacks       map[[2]string]uint64  // by from and to
+	errors          map[[2]string]uint64  // by stage and pinner
+}
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{
+		captureDuration: newHistogram(durationBuckets),
+		captureSize:     newHistogram(sizeBuckets),
+		pinDuration:     make(map[string]*histogram),
+		retries:         make(map[string]uint64),
+		fallbacks:       make(map[[2]string]uint64),
+		errors:          make(map[[2]string]uint64),
+	}
+}
+
+// ObserveCapture implements rivet.Metrics.
+func (r *Registry) ObserveCapture(d time.Duration, size int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.errors[[2]string{"capture", ""}]++
+		return
+	}
+	r.captureDuration.observe(d.Seconds())
+	r.captureSize.observe(float64(size))
+}
+
+// ObserveFallback implements rivet.Metrics.
+func (r *Registry) ObserveFallback(from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallbacks[[2]string{from, to}]++
+}
+
+// ObserveError implements rivet.Metrics.
+func (r *Registry) ObserveError(stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errors[[2]string{stage, ""}]++
+}
+
+// ObservePin implements ipfs.Metrics.
+func (r *Registry) ObservePin(target string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.errors[[2]string{"pin", target}]++
+		return
+	}
+	h, ok := r.pinDuration[target]
+	if !ok {
+		h = newHistogram(durationBuckets)
+		r.pinDuration[target] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// ObserveRetry implements ipfs.Metrics.
+func (r *Registry) ObserveRetry(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retries[target]++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w) // nolint:errcheck
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	header(&b, "rivet_capture_duration_seconds", "histogram", "Duration of successful captures.")
+	r.captureDuration.write(&b, "rivet_capture_duration_seconds", "")
+	header(&b, "rivet_capture_size_bytes", "histogram", "Size of the snapshots of successful captures.")
+	r.captureSize.write(&b, "rivet_capture_size_bytes", "")
+
+	header(&b, "rivet_pin_duration_seconds", "histogram", "Duration of successful pins by target.")
+	targets := make([]string, 0, len(r.pinDuration))
+	for target := range r.pinDuration {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		r.pinDuration[target].write(&b, "rivet_pin_duration_seconds", labels("target", target))
+	}
+
+	header(&b, "rivet_pin_retries_total", "counter", "Retries of pinning by target.")
+	targets = targets[:0]
+	for target := range r.retries {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		fmt.Fprintf(&b, "rivet_pin_retries_total{%s} %d\n", labels("target", target), r.retries[target])
+	}
+
+	header(&b, "rivet_pin_fallbacks_total", "counter", "Fallbacks to the next pinning service.")
+	for _, k := range sortedPairs(r.fallbacks) {
+		fmt.Fprintf(&b, "rivet_pin_fallbacks_total{%s} %d\n", labels("from", k[0], "to", k[1]), r.fallbacks[k])
+	}
+
+	header(&b, "rivet_errors_total", "counter", "Errors by stage and pinner.")
+	for _, k := range sortedPairs(r.errors) {
+		fmt.Fprintf(&b, "rivet_errors_total{%s} %d\n", labels("stage", k[0], "pinner", k[1]), r.errors[k])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// histogram is a cumulative histogram of observations.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // by bound, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func header(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels formats the pairs of label names and values.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	r.ObserveCapture(2*time.Second, 100<<10, nil)
+	r.ObserveCapture(time.Second, 0, errors.New("timeout"))
+	r.ObservePin("pinata", 3*time.Second, nil)
+	r.ObservePin("infura", time.Second, errors.New("unauthorized"))
+	r.ObserveRetry("infura")
+	r.ObserveRetry("infura")
+	r.ObserveFallback("infura", "pinata")
+	r.ObserveError("store")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected request: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type: %s", ct)
+	}
+	b, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		`rivet_capture_duration_seconds_bucket{le="1"} 0`,
+		`rivet_capture_duration_seconds_bucket{le="2.5"} 1`,
+		`rivet_capture_duration_seconds_bucket{le="+Inf"} 1`,
+		`rivet_capture_duration_seconds_sum 2`,
+		`rivet_capture_size_bytes_bucket{le="262144"} 1`,
+		`rivet_capture_size_bytes_count 1`,
+		`rivet_pin_duration_seconds_bucket{target="pinata",le="5"} 1`,
+		`rivet_pin_duration_seconds_count{target="pinata"} 1`,
+		`rivet_pin_retries_total{target="infura"} 2`,
+		`rivet_pin_fallbacks_total{from="infura",to="pinata"} 1`,
+		`rivet_errors_total{stage="capture",pinner=""} 1`,
+		`rivet_errors_total{stage="pin",pinner="infura"} 1`,
+		`rivet_errors_total{stage="store",pinner=""} 1`,
+		`# TYPE rivet_pin_duration_seconds histogram`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("Unexpected metrics, %q not found in:\n%s", line, b)
+		}
+	}
+}
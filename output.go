@@ -0,0 +1,153 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kennygrant/sanitize"
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplate is the default name of the stored snapshots in archive-only mode.
+const DefaultTemplate = "{host}{path}"
+
+// maxNameLength is the maximum length of a file name, leaving room for the suffixes.
+const maxNameLength = 240
+
+// filename returns the path of the snapshot within the output directory, without extension.
+func (s *Shaft) filename(snap *snapshot) string {
+	tmpl := s.Template
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	hash := snap.manifest.Digest()
+	name := strings.NewReplacer(
+		"{host}", sanitize.BaseName(snap.url.Host),
+		"{path}", sanitize.BaseName(snap.url.Path),
+		"{timestamp}", snap.manifest.Captured.UTC().Format("20060102150405"),
+		"{hash}", hash[:12],
+	).Replace(tmpl)
+
+	elems := strings.Split(filepath.ToSlash(name), "/")
+	for i, elem := range elems {
+		if elem == "." || elem == ".." {
+			elem = ""
+		}
+		if len(elem) > maxNameLength {
+			elem = elem[:maxNameLength]
+		}
+		elems[i] = elem
+	}
+	name = filepath.Join(elems...)
+	if name == "" || name == "." {
+		name = "snapshot"
+	}
+
+	return filepath.Join(s.Output, name)
+}
+
+// keepPage copies the webpage of the snapshot, or the file if the URL is
+// not a webpage, into the output directory.
+func (s *Shaft) keepPage(snap *snapshot) (string, error) {
+	src, err := os.Open(filepath.Join(snap.dir, snap.file))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var dst *os.File
+	name, err := unique(s.filename(snap), filepath.Ext(snap.file), func(path string) (err error) {
+		dst, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "create index file failed")
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", errors.Wrap(err, "create index file failed")
+	}
+	if err := dst.Close(); err != nil {
+		return "", errors.Wrap(err, "create index file failed")
+	}
+	return name, nil
+}
+
+// keepDir copies the whole directory of the snapshot into the output directory.
+func (s *Shaft) keepDir(snap *snapshot) (string, error) {
+	name, err := unique(s.filename(snap), "", func(path string) error {
+		return os.Mkdir(path, 0700)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "create directory failed")
+	}
+	if err := copyDir(snap.dir, name); err != nil {
+		return "", errors.Wrap(err, "copy snapshot failed")
+	}
+	return name, nil
+}
+
+// unique creates the file of the given name by create, appending a numeric suffix to
+// the name if it exists already. It returns the path of the created file.
+func unique(name, ext string, create func(path string) error) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return "", err
+	}
+	path := name + ext
+	for i := 2; ; i++ {
+		err := create(path)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		path = fmt.Sprintf("%s-%d%s", name, i, ext)
+	}
+}
+
+// copyDir copies the files of src into the existing directory dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.Mkdir(target, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
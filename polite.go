@@ -0,0 +1,225 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// robotsAgent is the product token matched against the user-agent lines of robots.txt.
+	robotsAgent = "rivet"
+	// robotsTTL is how long a robots.txt is cached.
+	robotsTTL = time.Hour
+	// maxRobotsSize is the maximum size of robots.txt parsed, as recommended by RFC 9309.
+	maxRobotsSize = 500 << 10
+)
+
+// ErrDisallowed is returned when the robots.txt of a site disallows capturing a URL.
+var ErrDisallowed = errors.New("disallowed by robots.txt")
+
+// politeness limits the requests to each host across all of the in-flight
+// captures of a Shaft, and caches the robots.txt of each host.
+type politeness struct {
+	concurrency int
+	interval    time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]*hostLimit
+	robots map[string]*robotsEntry
+}
+
+type hostLimit struct {
+	slots chan struct{} // nil if the concurrency is unlimited
+
+	mu   sync.Mutex
+	next time.Time // earliest start of the next request
+}
+
+type robotsEntry struct {
+	robots  *robots
+	err     error // reason to disallow every URL, e.g. robots.txt unreachable
+	expires time.Time
+}
+
+func (s *Shaft) politeness() *politeness {
+	s.politeOnce.Do(func() {
+		s.polite = &politeness{
+			concurrency: s.HostConcurrency,
+			interval:    s.HostInterval,
+			hosts:       make(map[string]*hostLimit),
+			robots:      make(map[string]*robotsEntry),
+		}
+	})
+	return s.polite
+}
+
+func (p *politeness) host(name string) *hostLimit {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.hosts[name]
+	if !ok {
+		h = &hostLimit{}
+		if p.concurrency > 0 {
+			h.slots = make(chan struct{}, p.concurrency)
+		}
+		p.hosts[name] = h
+	}
+	return h
+}
+
+// acquire waits for a slot and the interval to the previous request to the host,
+// the returned function must be called once the request is done.
+func (p *politeness) acquire(ctx context.Context, host string) (release func(), err error) {
+	h := p.host(strings.ToLower(host))
+	release = func() {}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+			release = func() { <-h.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if p.interval > 0 {
+		h.mu.Lock()
+		at := h.next
+		if now := time.Now(); at.Before(now) {
+			at = now
+		}
+		h.next = at.Add(p.interval)
+		h.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(at))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	return release, nil
+}
+
+type politeTransport struct {
+	base   http.RoundTripper
+	polite *politeness
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.polite.acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// The slot is held until the response has been read, rather than closed, for
+	// the resources of a webpage are fetched before its response is closed.
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// allowed returns an error wrapping ErrDisallowed if the robots.txt
+// of the site disallows capturing the given URL.
+func (s *Shaft) allowed(ctx context.Context, u *url.URL) error {
+	if !s.Robots || u.Path == "/robots.txt" {
+		return nil
+	}
+
+	p := s.politeness()
+	key := strings.ToLower(u.Scheme + "://" + u.Host)
+	p.mu.Lock()
+	e, ok := p.robots[key]
+	p.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		e = s.fetchRobots(ctx, key+"/robots.txt")
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.mu.Lock()
+		p.robots[key] = e
+		p.mu.Unlock()
+	}
+
+	if e.err != nil {
+		return errors.Wrapf(ErrDisallowed, "skip %s, %v", u, e.err)
+	}
+	if ok, r := e.robots.allowed(robotsAgent, u.RequestURI()); !ok {
+		return errors.Wrapf(ErrDisallowed, "skip %s, matched rule Disallow: %s", u, r.path)
+	}
+	return nil
+}
+
+// fetchRobots fetches and parses the robots.txt, following RFC 9309: any URL is allowed if
+// it is unavailable, and disallowed if it is unreachable.
+func (s *Shaft) fetchRobots(ctx context.Context, endpoint string) *robotsEntry {
+	e := &robotsEntry{robots: &robots{}, expires: time.Now().Add(robotsTTL)}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		e.err = fmt.Errorf("robots.txt unreachable: %v", err)
+		e.expires = time.Now().Add(time.Minute)
+		return e
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		e.err = fmt.Errorf("robots.txt unreachable with status code: %d", resp.StatusCode)
+		e.expires = time.Now().Add(time.Minute)
+	case resp.StatusCode >= 400:
+		// Unavailable, every URL is allowed.
+	default:
+		e.robots = parseRobots(io.LimitReader(resp.Body, maxRobotsSize))
+	}
+	return e
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Stage is a stage of archiving a webpage, see Progress.
+type Stage string
+
+const (
+	StageCapture Stage = "capture" // Capturing the webpage and its resources
+	StagePin     Stage = "pin"     // Pinning the snapshot
+	StageStore   Stage = "store"   // Storing the snapshot locally if ArchiveOnly is set
+	StageDone    Stage = "done"    // Archived
+	StageFailed  Stage = "failed"  // Failed to archive
+)
+
+// Progress is an interface for observing the progress of archiving webpages, such as a
+// progress bar. Its methods may be called concurrently, and should return quickly.
+type Progress interface {
+	// Stage reports that archiving the webpage of u entered the given stage.
+	Stage(u *url.URL, stage Stage)
+
+	// Fetched reports the resource of the webpage of u fetched, including
+	// the webpage itself, and its size in bytes.
+	Fetched(u *url.URL, resource *url.URL, size int64)
+
+	// Uploaded reports the bytes of the snapshot of u uploaded to the pinning
+	// service so far. It restarts from zero if the upload is retried.
+	Uploaded(u *url.URL, n int64)
+}
+
+type ctxKeyProgress struct{}
+
+// WithProgress returns a copy of ctx carrying the given observer of the
+// progress, which replaces Shaft.Progress for the calls made with it.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, ctxKeyProgress{}, p)
+}
+
+// tracker reports the progress of archiving the webpage of url, the nil tracker does nothing.
+type tracker struct {
+	url      *url.URL
+	progress Progress
+}
+
+type ctxKeyTracker struct{}
+
+// track returns the tracker of the request carried by ctx, see begin.
+func track(ctx context.Context) *tracker {
+	t, _ := ctx.Value(ctxKeyTracker{}).(*tracker)
+	return t
+}
+
+func (t *tracker) stage(stage Stage) {
+	if t != nil {
+		t.progress.Stage(t.url, stage)
+	}
+}
+
+// finish reports the last stage of the request, which failed if err is not nil.
+func (t *tracker) finish(err error) {
+	if err != nil {
+		t.stage(StageFailed)
+		return
+	}
+	t.stage(StageDone)
+}
+
+// fetchTransport reports the responses as fetched resources once their bodies are read.
+type fetchTransport struct {
+	base    http.RoundTripper
+	tracker *tracker
+}
+
+func (t *fetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	// Obelisk requests the webpage with HEAD first.
+	if err != nil || req.Method != http.MethodGet {
+		return resp, err
+	}
+	resource := req.URL
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+		t.tracker.progress.Fetched(t.tracker.url, resource, n)
+	}}
+	return resp, nil
+}
+
+// countingBody counts the bytes read from the body, and calls done with
+// the count once, at the end of the body or when it is closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+	read func(n int64) // optional, called after each read
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if n > 0 && b.read != nil {
+		b.read(b.n)
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *countingBody) finish() {
+	if b.done != nil {
+		b.once.Do(func() { b.done(b.n) })
+	}
+}
+
+// uploadTransport reports the bytes of the request bodies sent to the pinning service.
+type uploadTransport struct {
+	base    http.RoundTripper
+	tracker *tracker
+}
+
+func (t *uploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return base.RoundTrip(req)
+	}
+
+	// The request must not be modified, see http.RoundTripper.
+	r := req.Clone(req.Context())
+	r.Body = &countingBody{ReadCloser: req.Body, read: func(n int64) {
+		t.tracker.progress.Uploaded(t.tracker.url, n)
+	}}
+	return base.RoundTrip(r)
+}
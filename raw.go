@@ -0,0 +1,195 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-shiori/obelisk"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The webpage is retried on server errors like obelisk does for the resources.
+	downloadMaxElapsedTime = 30 * time.Second
+	downloadMaxRetries     = 3
+)
+
+// preferredExts holds the extensions of the media types for which
+// mime.ExtensionsByType returns an unusual one first.
+var preferredExts = map[string]string{
+	"audio/mpeg": ".mp3",
+	"image/jpeg": ".jpg",
+	"text/plain": ".txt",
+	"video/mp4":  ".mp4",
+}
+
+// download requests the webpage of the given uri, unless robots.txt disallows it. It fails
+// on the error statuses, retrying with backoff on network errors, server errors and 429.
+func (s *Shaft) download(ctx context.Context, uri string, arc *obelisk.Archiver) (*http.Response, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "archive failed")
+	}
+	if err := s.allowed(ctx, u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "archive failed")
+	}
+	req.Header.Set("User-Agent", arc.UserAgent)
+
+	client := &http.Client{Transport: arc.Transport}
+	var resp *http.Response
+	op := func() error {
+		resp, err = client.Do(req)
+		switch {
+		case err != nil:
+			err = errors.Wrap(err, "download failed")
+			if ctx.Err() != nil || errors.Is(err, ErrBlocked) || errors.Is(err, ErrTooLarge) || errors.Is(err, ErrNoSpace) {
+				return backoff.Permanent(err)
+			}
+			return err
+		case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+			return fmt.Errorf("download failed with status code: %d", resp.StatusCode)
+		case resp.StatusCode >= http.StatusBadRequest:
+			resp.Body.Close()
+			return backoff.Permanent(fmt.Errorf("download failed with status code: %d", resp.StatusCode))
+		}
+		return nil
+	}
+
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = downloadMaxElapsedTime
+	if err := backoff.Retry(op, backoff.WithContext(backoff.WithMaxRetries(exp, downloadMaxRetries), ctx)); err != nil {
+		return nil, errors.Wrap(err, "archive failed")
+	}
+	return resp, nil
+}
+
+// mediaType returns the media type of the response, sniffed from its content
+// if the Content-Type header is missing or generic.
+func mediaType(resp *http.Response, body *bufio.Reader) string {
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mt == "application/octet-stream" {
+		b, _ := body.Peek(512)
+		mt, _, _ = mime.ParseMediaType(http.DetectContentType(b))
+	}
+	return mt
+}
+
+func isHTML(mt string) bool {
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// writeRaw stores the content of a response that is not a webpage byte-for-byte into dir
+// under its original filename, with an index.html linking or embedding it.
+func writeRaw(dir string, resp *http.Response, body io.Reader, mt string) (file string, err error) {
+	file = rawName(resp, mt)
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "create file failed")
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return "", errors.Wrap(err, "archive failed: download failed")
+	}
+	if err := f.Close(); err != nil {
+		return "", errors.Wrap(err, "create file failed")
+	}
+
+	content := rawIndex(resp.Request.URL.String(), file, mt)
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), content, 0600); err != nil {
+		return "", errors.Wrap(err, "create index file failed")
+	}
+	return file, nil
+}
+
+// rawName returns the original filename of the response, from its Content-Disposition
+// header or URL, with an extension matching the media type if it has none.
+func rawName(resp *http.Response, mt string) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = path.Base(strings.ReplaceAll(params["filename"], `\`, "/"))
+	}
+	if name == "" || name == "." || name == "/" {
+		name = path.Base(resp.Request.URL.Path)
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Hidden files are not stored on IPFS.
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "file"
+	}
+
+	ext := path.Ext(name)
+	if ext == "" {
+		ext = preferredExts[mt]
+		if exts, _ := mime.ExtensionsByType(mt); ext == "" && len(exts) > 0 {
+			ext = exts[0]
+		}
+		name += ext
+	}
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength-len(ext)] + ext
+	}
+	// Avoids the generated files.
+	if name == "index.html" || name == ManifestFile || name == AttestationFile {
+		name = "original-" + name
+	}
+	return name
+}
+
+// rawIndex generates the webpage of a file that is not a webpage.
+func rawIndex(uri, file, mt string) []byte {
+	href := html.EscapeString((&url.URL{Path: file}).String())
+
+	var embed string
+	switch {
+	case strings.HasPrefix(mt, "image/"):
+		embed = fmt.Sprintf(`<img src="%s" alt="%s">`, href, html.EscapeString(file))
+	case strings.HasPrefix(mt, "video/"):
+		embed = fmt.Sprintf(`<video src="%s" controls></video>`, href)
+	case strings.HasPrefix(mt, "audio/"):
+		embed = fmt.Sprintf(`<audio src="%s" controls></audio>`, href)
+	case mt == "application/pdf":
+		embed = fmt.Sprintf(`<object data="%s" type="application/pdf" width="100%%" height="800"></object>`, href)
+	}
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n</head>\n<body>\n", html.EscapeString(uri))
+	fmt.Fprintf(&b, "<p><a href=\"%s\">%s</a> (%s) archived from <a href=\"%s\">%s</a></p>\n",
+		href, html.EscapeString(file), html.EscapeString(mt), html.EscapeString(uri), html.EscapeString(uri))
+	if embed != "" {
+		b.WriteString(embed + "\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+
+	return []byte(b.String())
+}
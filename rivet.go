@@ -5,18 +5,24 @@
 package rivet
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"filippo.io/age"
 	"github.com/go-shiori/obelisk"
 	"github.com/kennygrant/sanitize"
 	"github.com/pkg/errors"
@@ -25,9 +31,25 @@ import (
 
 // Shaft represents the rivet handler.
 type Shaft struct {
-	// Client represents a http client.
+	// Client represents a http client, for capturing webpages as well as
+	// for the pinning services that have no client of their own, see NewClient.
 	Client *http.Client
 
+	// Jar holds the cookies applied to the requests of the webpages and their
+	// resources, e.g. the session of a logged-in user, see LoadCookies.
+	// Defaults to the jar of Client.
+	Jar http.CookieJar
+
+	// UserAgent is the user agent of the requests, which the UserAgent of
+	// a matching rule overrides. Defaults to the one of obelisk.
+	UserAgent string
+
+	// Header holds the extra headers of the requests of the webpages and their
+	// resources, e.g. Accept-Language, Referer or Authorization. They are only sent
+	// to the host of the webpage, neither to the third-party resources nor to the
+	// other hosts it redirects to.
+	Header http.Header
+
 	// Hold specifies which IPFS mode to pin data through.
 	Hold ipfs.Pinning
 
@@ -37,69 +59,486 @@ type Shaft struct {
 
 	// Do not store file on any IPFS node, just archive
 	ArchiveOnly bool
+
+	// Output is the directory in which snapshots are stored if ArchiveOnly
+	// is set, defaults to the working directory.
+	Output string
+
+	// Template is the name of the snapshots stored if ArchiveOnly is set, the
+	// placeholders {host}, {path}, {timestamp} (capture time in UTC, formatted as
+	// 20060102150405) and {hash} (the first 12 digits of Manifest.Digest) are
+	// replaced, and slashes create subdirectories. Defaults to DefaultTemplate.
+	// A numeric suffix is appended to the name if it is taken already.
+	Template string
+
+	// KeepDir stores the whole snapshot directory including its resources and
+	// manifest if ArchiveOnly is set, rather than a lone webpage.
+	KeepDir bool
+
+	// WorkDir is the directory in which the snapshots are captured before being
+	// stored, defaults to os.TempDir(). It is created if missing.
+	WorkDir string
+
+	// MinFreeSpace is the bytes that must be free in WorkDir to start a capture,
+	// zero means no check. The capture fails with an error wrapping ErrNoSpace
+	// otherwise. It is not checked on the platforms other than Linux, macOS and
+	// FreeBSD.
+	MinFreeSpace int64
+
+	// DiskBudget limits the bytes downloaded into WorkDir by the in-flight captures
+	// in total, along with their encrypted copies written there, zero means no limit.
+	// The capture exceeding it stops downloading and fails with an error wrapping
+	// ErrNoSpace, as do the captures started meanwhile.
+	DiskBudget int64
+
+	// KeepFailed keeps the temporary directories of the failed captures in WorkDir
+	// for debugging, rather than removing them. Their paths are logged.
+	KeepFailed bool
+
+	// HostConcurrency limits the number of concurrent requests to each host,
+	// across all of the in-flight captures. Zero means no limit.
+	HostConcurrency int
+
+	// MaxCaptureSize limits the bytes downloaded by each capture, its webpages and
+	// their resources, zero means no limit. The capture exceeding it stops downloading
+	// and fails with an error wrapping ErrTooLarge. It is what bounds the memory used
+	// by a capture: only the webpage downloaded is streamed to disk, its resources and
+	// the webpage archived are held in memory by obelisk until it is written out.
+	MaxCaptureSize int64
+
+	// HostInterval is the minimum interval between the starts of requests
+	// to each host, across all of the in-flight captures. Note that the
+	// waiting counts toward the timeout of requesting resources.
+	HostInterval time.Duration
+
+	// Rules customize the capture of the webpages they match, the first
+	// matching rule applies. See Rule.
+	Rules []Rule
+
+	// Robots makes captures respect the robots.txt of the sites, a disallowed
+	// webpage fails with an error wrapping ErrDisallowed.
+	Robots bool
+
+	// Guard blocks the captures from connecting to private and internal networks
+	// if set, a blocked webpage fails with an error wrapping ErrBlocked while its
+	// blocked resources are skipped. The webhooks and pinning services are not
+	// guarded. It requires the transport of Client to be nil or an *http.Transport.
+	Guard *Guard
+
+	// Metrics observes the captures and pins, optional. If it implements
+	// ipfs.Metrics too, it observes the pinning services that have no metrics.
+	Metrics Metrics
+
+	// Logger receives the events of the captures and pins, with the URL and
+	// the ID of the request attached, see WithRequestID. If the pinning
+	// services have no logger, they log to it too. Optional.
+	Logger *slog.Logger
+
+	// Progress observes the progress of archiving each webpage, optional.
+	// It is replaced by the observer given by WithProgress.
+	Progress Progress
+
+	// Readable extracts the title, byline and main content of the webpages into the
+	// snapshots as ArticleMarkdown and ArticleText, for search and quick reading.
+	// The title is recorded in the manifest as well. A crawl stores them in the
+	// directory of each page.
+	Readable bool
+
+	// Canonical canonicalizes the URLs before archiving if set, so that their
+	// variants are archived under the same URL. The manifests record both the
+	// canonical URL and the one given.
+	Canonical *Canonical
+
+	// Index is the local full-text index to which the readable text of the
+	// snapshots is added once stored, keyed by URL, content-id and capture
+	// time, see Index.Search. The snapshots encrypted for Recipients are not
+	// indexed. Optional.
+	Index *Index
+
+	// SigningKey signs the manifest of every snapshot if set, the attestation
+	// is stored in the snapshot as AttestationFile, see VerifyAttestation.
+	SigningKey ed25519.PrivateKey
+
+	// Recipients encrypt the snapshots before pinning if set, e.g. age.X25519Recipient
+	// or a lone age.ScryptRecipient for a passphrase. The pinned directory then only
+	// holds the EncryptedFile, see Decrypt. Snapshots stored locally are not encrypted.
+	Recipients []age.Recipient
+
+	// Webhooks are notified once archiving each webpage completes, either way.
+	// The notifications are delivered in the background, see Shaft.Wait.
+	Webhooks []Webhook
+
+	// DeadLetter is the file to which the notifications that failed to be
+	// delivered are appended as JSON lines, optional.
+	DeadLetter string
+
+	deadMu         sync.Mutex
+	notifying      sync.WaitGroup
+	politeOnce     sync.Once
+	polite         *politeness
+	guardOnce      sync.Once
+	guardTransport http.RoundTripper
+	diskUsed       atomic.Int64
+}
+
+// Metrics is an interface for observing the captures, such as an exporter of metrics.
+type Metrics interface {
+	// ObserveCapture records the duration of capturing a webpage, the size in
+	// bytes of the snapshot, and the error if the capture failed.
+	ObserveCapture(d time.Duration, size int64, err error)
+
+	// ObserveFallback records falling back from the pinning
+	// service from to the service to, see ipfs.Pinning.Target.
+	ObserveFallback(from, to string)
+
+	// ObserveError records a failure of the given stage other than
+	// capturing and pinning, such as storing the snapshot locally.
+	ObserveError(stage string)
 }
 
 // Wayback uses IPFS to archive webpages.
 func (s *Shaft) Wayback(ctx context.Context, input *url.URL) (cid string, err error) {
+	res, err := s.Archive(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return res.Dest, nil
+}
+
+// Result describes an archived webpage.
+type Result struct {
+	// URL is the canonical URL of the webpage if Canonical
+	// is set, the one given otherwise.
+	URL string
+
+	// Dest is the destination of the snapshot, that is the gateway
+	// URL if pinned or the path if stored locally.
+	Dest string
+
+	// Title is the title of the webpage, only extracted if Readable or Index is set.
+	Title string
+
+	Manifest *Manifest
+}
+
+// Archive archives the webpage as Wayback does, and returns the result with its metadata.
+func (s *Shaft) Archive(ctx context.Context, input *url.URL) (res *Result, err error) {
+	ctx = s.begin(ctx, input)
+	var title string
+	defer func() {
+		var dest string
+		if res != nil {
+			dest = res.Dest
+		}
+		s.notify(ctx, input, dest, title, err)
+		track(ctx).finish(err)
+	}()
+
+	snap, err := s.capture(ctx, input, inputFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.discard(ctx, snap.dir, snap.budget, err) }()
+	title = snap.manifest.Title
+
+	dest, err := s.store(ctx, snap)
+	if err != nil {
+		return nil, err
+	}
+	s.index(ctx, Document{URL: snap.manifest.URL, Captured: snap.manifest.Captured, Dest: dest, Title: title}, snap.text)
+	return &Result{URL: snap.manifest.URL, Dest: dest, Title: title, Manifest: snap.manifest}, nil
+}
+
+// snapshot is a webpage captured into a temporary directory.
+type snapshot struct {
+	url      *url.URL
+	dir      string
+	file     string // name of the main file, index.html unless the URL is not a webpage
+	manifest *Manifest
+	text     string // readable text of the webpage, if extracted
+	budget   *budget
+}
+
+// capture archives the webpage into a temporary directory, which the caller must remove.
+// If page is not nil, the webpage is read from it instead of fetched.
+func (s *Shaft) capture(ctx context.Context, input *url.URL, page io.Reader) (snap *snapshot, err error) {
+	if s.Metrics != nil {
+		defer func(start time.Time) {
+			var size int64
+			if err == nil {
+				size = snap.manifest.size()
+			}
+			s.Metrics.ObserveCapture(time.Since(start), size, err)
+		}(time.Now())
+	}
+
+	track(ctx).stage(StageCapture)
+	if err := s.admit(ctx); err != nil {
+		return nil, err
+	}
+	ctx = s.withBudget(ctx)
+	given := input
+	input = s.canonicalize(input)
 	name := sanitize.BaseName(input.Host) + sanitize.BaseName(input.Path)
+	dir, err := mkdir(ctx, s.WorkDir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.discard(ctx, dir, budgetFrom(ctx), err)
+		}
+	}()
+
+	uri := input.String()
+	captured := time.Now()
+	_, file, err := s.archive(ctx, uri, page, dir)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		file = "index.html"
+	}
+
+	var content []byte
+	if file == "index.html" && (s.Readable || s.Index != nil || s.Canonical != nil && s.Canonical.Link) {
+		if content, err = ioutil.ReadFile(filepath.Join(dir, "index.html")); err != nil {
+			return nil, errors.Wrap(err, "read index file failed")
+		}
+	}
+	if s.Canonical != nil && s.Canonical.Link && content != nil {
+		if u := s.Canonical.link(content, input); u != nil && u.String() != uri {
+			logger(ctx).Info("canonical link resolved", "canonical", u.String())
+			input, uri = u, u.String()
+		}
+	}
+
+	var title, text string
+	if (s.Readable || s.Index != nil) && content != nil {
+		a, err := readable(content, input)
+		if err != nil {
+			return nil, err
+		}
+		if s.Readable {
+			if err := writeArticle(dir, a); err != nil {
+				return nil, err
+			}
+		}
+		title, text = a.title, a.text()
+	}
+
+	source := SourceFetched
+	if page != nil {
+		source = SourceSubmitted
+	}
+	m, err := writeManifest(dir, Manifest{URL: uri, Original: original(given, input), Title: title, Captured: captured, Source: source})
+	if err != nil {
+		return nil, err
+	}
+	if s.SigningKey != nil {
+		if err := attest(dir, m, s.SigningKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &snapshot{url: input, dir: dir, file: file, manifest: m, text: text, budget: budgetFrom(ctx)}, nil
+}
+
+// store pins the snapshot, or copies it into the output directory
+// if ArchiveOnly is set. It returns the destination.
+func (s *Shaft) store(ctx context.Context, snap *snapshot) (dest string, err error) {
+	if !s.ArchiveOnly {
+		return s.pin(ctx, snap.dir)
+	}
+	track(ctx).stage(StageStore)
+	defer func() {
+		if err != nil {
+			logger(ctx).Error("store failed", "error", err)
+			if s.Metrics != nil {
+				s.Metrics.ObserveError("store")
+			}
+			return
+		}
+		logger(ctx).Info("stored", "dest", dest)
+	}()
+	if s.KeepDir {
+		return s.keepDir(snap)
+	}
+	return s.keepPage(snap)
+}
+
+// mkdir creates a temporary directory in parent, or os.TempDir() if empty, to hold the
+// snapshot of the given name.
+func mkdir(ctx context.Context, parent, name string) (string, error) {
 	dir := "rivet-" + name
 	if len(dir) > 255 {
 		dir = dir[:254]
 	}
 
-	dir, err = ioutil.TempDir(os.TempDir(), dir+"-")
+	if parent != "" {
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return "", errors.Wrap(err, "create work directory failed: "+parent)
+		}
+	}
+	dir, err := ioutil.TempDir(parent, dir+"-")
 	if err != nil {
 		return "", errors.Wrap(err, "create temp directory failed: "+dir)
 	}
-	defer os.RemoveAll(dir)
+	logger(ctx).Debug("temp directory created", "dir", dir)
+	return dir, nil
+}
+
+// archive saves the webpage of the given uri with its resources into dir as index.html.
+// If input is not nil, the webpage is read from it instead of fetched. If the uri is not
+// a webpage, its content is stored in dir as file and index.html links or embeds it. If it
+// is fetched, the URL it ends up at after redirects is returned as final.
+func (s *Shaft) archive(ctx context.Context, uri string, input io.Reader, dir string) (final *url.URL, file string, err error) {
+	log := logger(ctx).With("page", uri)
+	log.Info("archive started")
+	defer func(start time.Time) {
+		if err != nil {
+			log.Error("archive failed", "error", err)
+			return
+		}
+		log.Info("archive finished", "duration", time.Since(start))
+	}(time.Now())
+
+	rule := s.rule(uri)
+	if rule.UserAgent == "" {
+		rule.UserAgent = s.UserAgent
+	}
+	transport := s.client().Transport
+	if u, err := url.Parse(uri); err == nil && len(s.Header) > 0 {
+		transport = &headerTransport{base: transport, header: s.Header, host: u.Host}
+	}
+	if rule.MaxSize > 0 {
+		transport = &limitTransport{base: transport, max: rule.MaxSize}
+	}
+	if t := track(ctx); t != nil {
+		transport = &fetchTransport{base: transport, tracker: t}
+	}
+	b := budgetFrom(ctx)
+	if b != nil {
+		transport = &budgetTransport{base: transport, budget: b}
+	}
+	timeout := rule.Timeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
 
-	uri := input.String()
-	req := obelisk.Request{URL: uri, Input: inputFromContext(ctx)}
 	arc := &obelisk.Archiver{
-		DisableJS: isDisableJS(uri),
+		// DISABLEJS_URIS is deprecated in favor of rules, but still honored.
+		DisableJS:     rule.DisableJS || isDisableJS(uri),
+		DisableCSS:    rule.DisableCSS,
+		DisableEmbeds: rule.DisableEmbeds,
+		DisableMedias: rule.DisableMedias,
 
 		SkipResourceURLError: true,
 
+		UserAgent:      rule.UserAgent,
 		WrapDirectory:  dir,
-		RequestTimeout: 3 * time.Second,
-	}
-	if s.Client != nil {
-		arc.Transport = s.Client.Transport
+		RequestTimeout: timeout,
+
+		Transport: transport,
 	}
 	arc.Validate()
+	if s.HostConcurrency > 0 && int64(s.HostConcurrency) < arc.MaxConcurrentDownload {
+		arc.MaxConcurrentDownload = int64(s.HostConcurrency)
+	}
 
-	content, _, err := arc.Archive(ctx, req)
-	if err != nil {
-		return "", errors.Wrap(err, "archive failed")
+	if input == nil {
+		resp, err := s.download(ctx, uri, arc)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+
+		body := bufio.NewReader(resp.Body)
+		final = resp.Request.URL
+		if mt := mediaType(resp, body); !isHTML(mt) {
+			file, err := writeRaw(dir, resp, body, mt)
+			return final, file, err
+		}
+		// Reads the webpage ahead to release the request, its resources may
+		// wait for it otherwise, see HostConcurrency. It is streamed to a
+		// hidden file, which is not stored, rather than held in memory.
+		page, err := spool(dir, body)
+		if err != nil {
+			return nil, "", err
+		}
+		defer func() {
+			page.Close()
+			os.Remove(page.Name())
+		}()
+		input, uri = page, resp.Request.URL.String()
 	}
 
+	content, _, err := arc.Archive(ctx, obelisk.Request{URL: uri, Input: input})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "archive failed")
+	}
+	// The resources failing are skipped, so does the ones over the budget.
+	if err := b.check(); err != nil {
+		return nil, "", errors.Wrap(err, "archive failed")
+	}
 	// For auto indexing in IPFS, the filename should be index.html.
-	indexFile := filepath.Join(dir, "index.html")
-	if s.ArchiveOnly {
-		indexFile = name + ".html"
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), content, 0600); err != nil {
+		return nil, "", errors.Wrap(err, "create index file failed")
 	}
+	return final, "", nil
+}
 
-	if err := ioutil.WriteFile(indexFile, content, 0600); err != nil {
-		return "", errors.Wrap(err, "create index file failed")
+// spool copies the webpage into a hidden file of dir, and returns it rewound.
+func spool(dir string, r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp(dir, ".page-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "create spool file failed")
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "archive failed: download failed")
 	}
+	return f, nil
+}
 
-	if s.ArchiveOnly {
-		return indexFile, nil
+// pin stores the directory through the Hold pinning service, or the Next one if it fails,
+// and returns the gateway URL of the directory. It is encrypted first if Recipients is set.
+func (s *Shaft) pin(ctx context.Context, dir string) (cid string, err error) {
+	if len(s.Recipients) > 0 {
+		enc, err := encrypt(ctx, s.WorkDir, dir, s.Recipients)
+		if err != nil {
+			return "", err
+		}
+		defer cleanup(ctx, enc)
+		dir = enc
 	}
 
-	switch s.Hold.Mode {
+	track(ctx).stage(StagePin)
+	hold, next := s.pinning(ctx, s.Hold), s.pinning(ctx, s.Next)
+	switch hold.Mode {
 	case ipfs.Local:
-		cid, err = (&ipfs.Locally{Pinning: s.Hold}).PinDir(dir)
+		cid, err = (&ipfs.Locally{Pinning: hold}).PinDir(dir)
 	case ipfs.Remote:
-		cid, err = (&ipfs.Remotely{Pinning: s.Hold}).PinDir(dir)
+		cid, err = (&ipfs.Remotely{Pinning: hold}).PinDir(dir)
 	}
 	if err != nil {
 		// Try fallback pinning service
-		switch s.Next.Mode {
+		if next.Mode != 0 {
+			logger(ctx).Warn("falling back to next pinning service", "from", hold.Target(), "to", next.Target(), "error", err)
+			if s.Metrics != nil {
+				s.Metrics.ObserveFallback(hold.Target(), next.Target())
+			}
+		}
+		switch next.Mode {
 		case ipfs.Local:
-			cid, err = (&ipfs.Locally{Pinning: s.Next}).PinDir(dir)
+			cid, err = (&ipfs.Locally{Pinning: next}).PinDir(dir)
 		case ipfs.Remote:
-			cid, err = (&ipfs.Remotely{Pinning: s.Next}).PinDir(dir)
+			cid, err = (&ipfs.Remotely{Pinning: next}).PinDir(dir)
 		}
 		if err != nil {
 			return "", errors.Wrap(err, "pin failed")
@@ -108,8 +547,38 @@ func (s *Shaft) Wayback(ctx context.Context, input *url.URL) (cid string, err er
 	if cid == "" {
 		return "", errors.New("cid empty")
 	}
+	logger(ctx).Info("pinned", "cid", cid)
 
-	return "https://ipfs.io/ipfs/" + cid, nil
+	return gateway + cid, nil
+}
+
+// pinning returns the pinning service p using Client and Metrics, unless p has its own,
+// and logging to its own logger or Logger with the request of ctx attached. Its uploads
+// are reported to the tracker of ctx.
+func (s *Shaft) pinning(ctx context.Context, p ipfs.Pinning) ipfs.Pinning {
+	opts := []ipfs.PinningOption{ipfs.Logger(logger(ctx))}
+	if p.Logger != nil {
+		opts[0] = ipfs.Logger(p.Logger.With("request_id", RequestID(ctx)))
+	}
+	client := p.Client
+	if client == nil {
+		client = s.Client
+	}
+	if t := track(ctx); t != nil {
+		c := &http.Client{}
+		if client != nil {
+			*c = *client
+		}
+		c.Transport = &uploadTransport{base: c.Transport, tracker: t}
+		client = c
+	}
+	if client != nil {
+		opts = append(opts, ipfs.Client(client))
+	}
+	if m, ok := s.Metrics.(ipfs.Metrics); ok && p.Metrics == nil {
+		opts = append(opts, ipfs.Observe(m))
+	}
+	return p.With(opts...)
 }
 
 type ctxKeyInput struct{}
@@ -126,6 +595,9 @@ func inputFromContext(ctx context.Context) io.Reader {
 	return nil
 }
 
+// isDisableJS reports whether the link matches the DISABLEJS_URIS environment variable.
+//
+// Deprecated: use a Rule with DisableJS instead.
 func isDisableJS(link string) bool {
 	// e.g. DISABLEJS_URIS=wikipedia.org|eff.org/tags
 	uris := os.Getenv("DISABLEJS_URIS")
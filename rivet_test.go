@@ -3,20 +3,43 @@ package rivet
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	"github.com/ipfs/go-cid"
 	"github.com/wabarc/helper"
 	"github.com/wabarc/ipfs-pinner"
 	"github.com/wabarc/rivet/ipfs"
+	"github.com/wabarc/rivet/ipfs/ipfstest"
+	"github.com/wabarc/rivet/ipfs/unixfs"
 )
 
 var (
@@ -141,6 +164,13 @@ func handleResponse(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// local returns the pinning to the fake Kubo node, which is reached directly
+// since the mock client reaches the mock server only.
+func local(k *ipfstest.Kubo) ipfs.Pinning {
+	host, port := k.Addr()
+	return ipfs.Options(ipfs.Mode(ipfs.Local), ipfs.Host(host), ipfs.Port(port), ipfs.Client(&http.Client{}))
+}
+
 func TestWayback(t *testing.T) {
 	client, mux, server := helper.MockServer()
 	mux.HandleFunc("/", handleResponse)
@@ -168,6 +198,303 @@ func TestWayback(t *testing.T) {
 	}
 }
 
+func TestWaybackKubo(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+
+	r := &Shaft{Hold: local(kubo), Client: client}
+	input, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := r.Wayback(context.TODO(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := kubo.Pinner.Calls(); len(calls) != 1 || dest != gateway+calls[0].CID {
+		t.Errorf("Unexpected pins: %+v, dest: %s", calls, dest)
+	}
+}
+
+type recorder struct {
+	mu        sync.Mutex
+	captures  []int64
+	fallbacks []string
+	pins      []string
+}
+
+func (r *recorder) ObserveCapture(_ time.Duration, size int64, _ error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.captures = append(r.captures, size)
+}
+
+func (r *recorder) ObserveFallback(from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallbacks = append(r.fallbacks, from+">"+to)
+}
+
+func (r *recorder) ObserveError(string) {}
+
+func (r *recorder) ObservePin(target string, _ time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pins = append(r.pins, fmt.Sprintf("%s:%t", target, err == nil))
+}
+
+func (r *recorder) ObserveRetry(string) {}
+
+func TestWaybackMetrics(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	m := &recorder{}
+	r := &Shaft{
+		Client:  client,
+		Hold:    ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata)),
+		Next:    ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata), ipfs.Apikey(apikey), ipfs.Secret(secret)),
+		Metrics: m,
+	}
+	input, _ := url.Parse(server.URL)
+	if _, err := r.Wayback(context.TODO(), input); err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+
+	if len(m.captures) != 1 || m.captures[0] <= 0 {
+		t.Errorf("Unexpected captures observed: %v", m.captures)
+	}
+	if len(m.fallbacks) != 1 || m.fallbacks[0] != "pinata>pinata" {
+		t.Errorf("Unexpected fallbacks observed: %v", m.fallbacks)
+	}
+	if strings.Join(m.pins, " ") != "pinata:false pinata:true" {
+		t.Errorf("Unexpected pins observed: %v", m.pins)
+	}
+}
+
+func TestArchiveFallback(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, content)
+	})
+	defer server.Close()
+
+	hold := ipfstest.NewKubo(&ipfstest.Pinner{Err: errors.New("unavailable")})
+	defer hold.Close()
+	next := ipfstest.NewKubo(nil)
+	defer next.Close()
+
+	r := &Shaft{Client: client, Hold: local(hold), Next: local(next)}
+	input, _ := url.Parse(server.URL)
+	res, err := r.Archive(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+
+	if calls := hold.Pinner.Calls(); len(calls) != 1 || calls[0].Err == nil {
+		t.Errorf("Unexpected pins to the failing node: %+v", calls)
+	}
+	calls := next.Pinner.Calls()
+	if len(calls) != 1 || res.Dest != gateway+calls[0].CID {
+		t.Fatalf("Unexpected pins to the next node: %+v, dest: %s", calls, res.Dest)
+	}
+	b, err := next.Pinner.Block(context.TODO(), calls[0].CID)
+	if err != nil {
+		t.Fatalf("Unexpected block of the snapshot: %v", err)
+	}
+	n, err := unixfs.Decode(b)
+	if err != nil {
+		t.Fatalf("Unexpected decode of the snapshot: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, l := range n.Links {
+		names[l.Name] = true
+	}
+	if !names["index.html"] || !names[ManifestFile] {
+		t.Errorf("Unexpected files pinned: %v", names)
+	}
+}
+
+type progress struct {
+	mu       sync.Mutex
+	stages   []string
+	fetched  []string
+	uploaded int64
+}
+
+func (p *progress) Stage(_ *url.URL, stage Stage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages = append(p.stages, string(stage))
+}
+
+func (p *progress) Fetched(_ *url.URL, resource *url.URL, _ int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetched = append(p.fetched, resource.String())
+}
+
+func (p *progress) Uploaded(_ *url.URL, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uploaded = n
+}
+
+func TestWaybackProgress(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	p := &progress{}
+	r := &Shaft{
+		Client: client,
+		Hold:   ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata), ipfs.Apikey(apikey), ipfs.Secret(secret)),
+	}
+	input, _ := url.Parse(server.URL)
+	if _, err := r.Wayback(WithProgress(context.TODO(), p), input); err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+
+	if stages := strings.Join(p.stages, " "); stages != "capture pin done" {
+		t.Errorf("Unexpected stages, got %q instead of %q", stages, "capture pin done")
+	}
+	if len(p.fetched) == 0 || p.fetched[0] != server.URL {
+		t.Errorf("Unexpected fetched resources: %v", p.fetched)
+	}
+	if p.uploaded <= 0 {
+		t.Errorf("Unexpected uploaded bytes: %d", p.uploaded)
+	}
+}
+
+func TestWaybackLogger(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	r := &Shaft{
+		Client: client,
+		Hold:   ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata)),
+		Next:   ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata), ipfs.Apikey(apikey), ipfs.Secret(secret)),
+		Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	input, _ := url.Parse(server.URL)
+	ctx := WithRequestID(context.TODO(), "abc")
+	if _, err := r.Wayback(ctx, input); err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+
+	var msgs []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event map[string]interface{}
+		if err := dec.Decode(&event); err != nil {
+			t.Fatalf("Unexpected log event: %v", err)
+		}
+		if event["request_id"] != "abc" || event["url"] != server.URL {
+			t.Errorf("Unexpected attributes of %q: %v", event["msg"], event)
+		}
+		msgs = append(msgs, event["msg"].(string))
+	}
+
+	expected := []string{
+		"temp directory created",
+		"archive started",
+		"archive finished",
+		"pin attempt",
+		"pin attempt failed",
+		"pin failed",
+		"falling back to next pinning service",
+		"pin attempt",
+		"pinned",
+		"temp directory removed",
+	}
+	if strings.Join(msgs, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected log events, got %q instead of %q", msgs, expected)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	var (
+		mu            sync.Mutex
+		notifications []Notification
+	)
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get(SignatureHeader); sig != Sign("secret", body) {
+			t.Errorf("Unexpected signature: %s", sig)
+		}
+		var n Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("Unexpected notification: %v", err)
+		}
+		mu.Lock()
+		notifications = append(notifications, n)
+		mu.Unlock()
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	release := make(chan struct{})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	dead := filepath.Join(t.TempDir(), "dead.jsonl")
+	r := &Shaft{
+		Client: client,
+		Hold:   ipfs.Options(ipfs.Mode(ipfs.Remote), ipfs.Uses(pinner.Pinata), ipfs.Apikey(apikey), ipfs.Secret(secret)),
+		Webhooks: []Webhook{
+			{URL: "http://hooks.example/hook", Secret: "secret"},
+			{URL: "http://hooks.example/gone"},
+			{URL: "http://hooks.example/slow"},
+		},
+		DeadLetter: dead,
+	}
+	input, _ := url.Parse(server.URL)
+	// Archiving does not wait for the slow webhook.
+	dest, err := r.Wayback(WithRequestID(context.TODO(), "abc"), input)
+	if err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+	close(release)
+	r.Wait()
+
+	if len(notifications) != 1 {
+		t.Fatalf("Unexpected notifications: %v", notifications)
+	}
+	n := notifications[0]
+	if n.Event != EventArchived || n.URL != server.URL || n.RequestID != "abc" || n.Dest != dest {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+	if n.CID == "" || len(n.Gateways) == 0 || n.Gateways[0] != dest {
+		t.Errorf("Unexpected cid or gateways of notification: %+v", n)
+	}
+
+	b, err := os.ReadFile(dead)
+	if err != nil {
+		t.Fatalf("Unexpected read dead-letter file: %v", err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(b, &letter); err != nil {
+		t.Fatalf("Unexpected dead letter: %v", err)
+	}
+	if letter.Webhook != "http://hooks.example/gone" || letter.Notification.CID != n.CID || !strings.Contains(letter.Error, "410") {
+		t.Errorf("Unexpected dead letter: %s", b)
+	}
+}
+
 func TestWaybackWithInput(t *testing.T) {
 	client, mux, server := helper.MockServer()
 	mux.HandleFunc("/", handleResponse)
@@ -194,4 +521,1500 @@ func TestWaybackWithInput(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// The webpage submitted is recorded as such.
+	r = &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: t.TempDir()}
+	res, err := r.Archive(r.WithInput(context.TODO(), []byte(content)), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Manifest.Source != SourceSubmitted {
+		t.Errorf("Unexpected source of the webpage submitted: %q", res.Manifest.Source)
+	}
+}
+
+func TestWaybackWithInputKubo(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", handleResponse)
+	defer server.Close()
+
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+
+	r := &Shaft{Hold: local(kubo), Client: client}
+	input, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := r.Wayback(r.WithInput(context.TODO(), []byte(content)), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := kubo.Pinner.Calls(); len(calls) != 1 || dest != gateway+calls[0].CID {
+		t.Errorf("Unexpected pins: %+v, dest: %s", calls, dest)
+	}
+}
+
+func TestWaybackArchiveOnly(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><body>%s</body></html>", r.URL.Path)
+	})
+	defer server.Close()
+
+	out := t.TempDir()
+	r := &Shaft{Client: client, ArchiveOnly: true, Output: out}
+	var dests []string
+	// Both paths sanitize to the same name.
+	for _, path := range []string{"/a-b", "/a/b"} {
+		input, _ := url.Parse(server.URL + path)
+		dest, err := r.Wayback(context.TODO(), input)
+		if err != nil {
+			t.Fatalf("Unexpected wayback: %v", err)
+		}
+		dests = append(dests, dest)
+	}
+	if dests[0] == dests[1] {
+		t.Fatalf("Unexpected same destination: %s", dests[0])
+	}
+	for i, path := range []string{"/a-b", "/a/b"} {
+		if filepath.Dir(dests[i]) != out || filepath.Ext(dests[i]) != ".html" {
+			t.Errorf("Unexpected destination: %s", dests[i])
+		}
+		b, err := os.ReadFile(dests[i])
+		if err != nil || !strings.Contains(string(b), path) {
+			t.Errorf("Unexpected webpage of %s: %s, %v", path, b, err)
+		}
+	}
+
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: out, KeepDir: true, Template: "{host}/{timestamp}-{hash}"}
+	input, _ := url.Parse(server.URL + "/a-b")
+	dest, err := r.Wayback(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+	if !regexp.MustCompile(`/[^/]+/\d{14}-[0-9a-f]{12}$`).MatchString(filepath.ToSlash(dest)) {
+		t.Errorf("Unexpected destination: %s", dest)
+	}
+	m, err := ReadManifest(filepath.Join(dest, ManifestFile))
+	if err != nil {
+		t.Fatalf("Unexpected manifest: %v", err)
+	}
+	if m.URL != input.String() {
+		t.Errorf("Unexpected manifest url: %s", m.URL)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "index.html")); err != nil {
+		t.Errorf("Unexpected missing webpage: %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+  {"host": "example.org", "disable_js": true, "timeout": "10s"},
+  {"match": "/large", "max_size": 1024, "user_agent": "rivet-test"}
+]`
+	if err := os.WriteFile(file, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := &Shaft{}
+	var err error
+	if r.Rules, err = LoadRules(file); err != nil {
+		t.Fatalf("Unexpected load rules: %v", err)
+	}
+
+	if rule := r.rule("https://www.example.org/a"); !rule.DisableJS || rule.Timeout != 10*time.Second {
+		t.Errorf("Unexpected rule of subdomain: %+v", rule)
+	}
+	if rule := r.rule("https://example.com/large"); rule.MaxSize != 1024 || rule.UserAgent != "rivet-test" {
+		t.Errorf("Unexpected rule of match: %+v", rule)
+	}
+	if rule := r.rule("https://notexample.org/"); rule.DisableJS || rule.MaxSize != 0 {
+		t.Errorf("Unexpected rule of unmatched url: %+v", rule)
+	}
+
+	var agent string
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.png", "/big.png":
+			agent = r.UserAgent()
+			size := 16
+			if r.URL.Path == "/big.png" {
+				size = 4096
+			}
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(bytes.Repeat([]byte{'x'}, size))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><body><script>alert(1)</script><img src="/small.png"><img src="/big.png"></body></html>`))
+		}
+	})
+	defer server.Close()
+
+	r.Client = client
+	r.Rules = []Rule{{Match: regexp.MustCompile("/large"), DisableJS: true, MaxSize: 1024, UserAgent: "rivet-test"}}
+	dir := t.TempDir()
+	input, _ := url.Parse(server.URL + "/large")
+	if _, _, err := r.archive(context.TODO(), input.String(), nil, dir); err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "index.html"))
+	if strings.Contains(string(b), "alert(1)") {
+		t.Errorf("Unexpected script in webpage: %s", b)
+	}
+	if agent != "rivet-test" {
+		t.Errorf("Unexpected user agent: %s", agent)
+	}
+	sizes := map[int64]bool{}
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			sizes[info.Size()] = true
+		}
+		return err
+	})
+	if !sizes[16] || sizes[4096] {
+		t.Errorf("Unexpected resources stored, want the small one only, got sizes %v", sizes)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	var resource bool
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		if err != nil || c.Value != "secret" {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if _, err := r.Cookie("other"); err == nil {
+			http.Error(w, "unexpected cookie", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/style.css":
+			resource = true
+			w.Header().Set("Content-Type", "text/css")
+			_, _ = w.Write([]byte("body{}"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"></head><body>account</body></html>`))
+		}
+	})
+	defer server.Close()
+
+	input, _ := url.Parse(server.URL + "/account")
+	cookies := "# Netscape HTTP Cookie File\n" +
+		"#HttpOnly_" + input.Hostname() + "\tFALSE\t/\tFALSE\t0\tsession\tsecret\n" +
+		input.Hostname() + "\tFALSE\t/other\tFALSE\t0\tother\tvalue\n"
+	jar, err := ParseCookies(strings.NewReader(cookies))
+	if err != nil {
+		t.Fatalf("Unexpected parse cookies: %v", err)
+	}
+
+	r := &Shaft{Client: client, Jar: jar}
+	dir := t.TempDir()
+	if _, _, err := r.archive(context.TODO(), input.String(), nil, dir); err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "index.html"))
+	if !strings.Contains(string(b), "account") {
+		t.Errorf("Unexpected webpage: %s", b)
+	}
+	if !resource {
+		t.Error("Unexpected resource requested without cookies")
+	}
+
+	if _, err := ParseCookies(strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Error("Unexpected parse of invalid cookies")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	requests, thirdParty := 0, []string(nil)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The third-party resource gets the user agent only.
+		if r.Host == "cdn.example" {
+			thirdParty = append(thirdParty, r.UserAgent()+"|"+r.Header.Get("Accept-Language"))
+			w.Header().Set("Content-Type", "text/css")
+			_, _ = w.Write([]byte("p{}"))
+			return
+		}
+		if r.UserAgent() != "rivet-test" || r.Header.Get("Accept-Language") != "de" {
+			http.Error(w, "unexpected headers", http.StatusForbidden)
+			return
+		}
+		requests++
+		switch r.URL.Path {
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			_, _ = w.Write([]byte("body{}"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"><link rel="stylesheet" href="http://cdn.example/lib.css"></head><body>Hallo</body></html>`))
+		}
+	})
+	defer server.Close()
+
+	r := &Shaft{Client: client, UserAgent: "rivet-test", Header: http.Header{"Accept-Language": {"de"}}}
+	dir := t.TempDir()
+	if _, _, err := r.archive(context.TODO(), server.URL, nil, dir); err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "index.html"))
+	if !strings.Contains(string(b), "Hallo") {
+		t.Errorf("Unexpected webpage: %s", b)
+	}
+	// The HEAD and GET requests of the webpage, and the resource.
+	if requests != 3 {
+		t.Errorf("Unexpected number of requests with the headers, got %d instead of 3", requests)
+	}
+	if len(thirdParty) != 1 || thirdParty[0] != "rivet-test|" {
+		t.Errorf("Unexpected headers sent to the third-party resource: %q", thirdParty)
+	}
+}
+
+func TestWaybackRaw(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n")
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/docs/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = w.Write(pdf)
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", `attachment; filename="chart"`)
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	})
+	defer server.Close()
+
+	out := t.TempDir()
+	r := &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: out}
+	input, _ := url.Parse(server.URL + "/docs/report.pdf")
+	dest, err := r.Wayback(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "report.pdf"))
+	if err != nil || !bytes.Equal(b, pdf) {
+		t.Fatalf("Unexpected stored file: %q, %v", b, err)
+	}
+	index, err := os.ReadFile(filepath.Join(dest, "index.html"))
+	if err != nil || !strings.Contains(string(index), `data="report.pdf"`) {
+		t.Errorf("Unexpected index of file: %s, %v", index, err)
+	}
+
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: out}
+	input, _ = url.Parse(server.URL + "/download")
+	dest, err = r.Wayback(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected wayback: %v", err)
+	}
+	if filepath.Ext(dest) != ".png" {
+		t.Errorf("Unexpected destination of image: %s", dest)
+	}
+	if b, _ := os.ReadFile(dest); !bytes.HasPrefix(b, []byte("\x89PNG")) {
+		t.Errorf("Unexpected stored image: %q", b)
+	}
+}
+
+func TestWaybackErrorStatus(t *testing.T) {
+	var attempts atomic.Int32
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, content)
+	})
+	mux.HandleFunc("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, content)
+	})
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		status   string
+		attempts int32
+	}{
+		{"/missing", "404", 1},
+		{"/unavailable", "503", 1 + downloadMaxRetries},
+	}
+	for _, test := range tests {
+		attempts.Store(0)
+		r := &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir()}
+		input, _ := url.Parse(server.URL + test.path)
+		if _, err := r.Wayback(context.TODO(), input); err == nil || !strings.Contains(err.Error(), test.status) {
+			t.Errorf("Unexpected wayback of %s: %v", test.path, err)
+		}
+		if n := attempts.Load(); n != test.attempts {
+			t.Errorf("Unexpected attempts of %s got %d instead of %d", test.path, n, test.attempts)
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("proxy " + r.URL.Host))
+	}))
+	defer proxy.Close()
+
+	cacert := filepath.Join(t.TempDir(), "ca.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw})
+	if err := os.WriteFile(cacert, block, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(proxy.URL, cacert)
+	if err != nil {
+		t.Fatalf("Unexpected new client: %v", err)
+	}
+	get := func(link string) string {
+		resp, err := client.Get(link)
+		if err != nil {
+			t.Fatalf("Unexpected request: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if got := get("http://example.org/"); got != "proxy example.org" {
+		t.Errorf("Unexpected request not through the proxy: %s", got)
+	}
+	// Loopback addresses are requested directly, trusting the given certificate.
+	if got := get(origin.URL); got != "origin" {
+		t.Errorf("Unexpected response of origin: %s", got)
+	}
+
+	if _, err := NewClient("ftp://127.0.0.1:21", ""); err == nil {
+		t.Error("Unexpected proxy of unsupported scheme")
+	}
+}
+
+func TestGuardCheck(t *testing.T) {
+	g := &Guard{Block: []netip.Prefix{netip.MustParsePrefix("172.32.0.0/16")}, Allow: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"169.254.169.254", true},
+		{"127.0.0.1", true},
+		{"192.168.1.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"2002:c0a8:101::1", true},
+		{"fe80::1%eth0", true},
+		{"172.32.0.7", true},
+		{"192.0.2.1", true},
+		{"198.51.100.1", true},
+		{"203.0.113.7", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+	for _, test := range tests {
+		err := g.Check(netip.MustParseAddr(test.addr))
+		if blocked := errors.Is(err, ErrBlocked); blocked != test.blocked {
+			t.Errorf("Unexpected check of %s: %v", test.addr, err)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	// The resource is served from another loopback address, which the guard tells apart.
+	other, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Listen on 127.0.0.2 failed: %v", err)
+	}
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secret")
+	}))
+	internal.Listener.Close()
+	internal.Listener = other
+	internal.Start()
+	defer internal.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><p>page</p><iframe src="%s/frame"></iframe></body></html>`, internal.URL)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	allow := []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	// archive returns the content of the files of the snapshot.
+	archive := func(g *Guard, link string) (string, error) {
+		r := &Shaft{Client: &http.Client{}, ArchiveOnly: true, KeepDir: true, Output: t.TempDir(), Guard: g}
+		input, _ := url.Parse(link)
+		dest, err := r.Wayback(context.TODO(), input)
+		if err != nil {
+			return "", err
+		}
+		var content strings.Builder
+		err = filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(path)
+			content.Write(b)
+			return err
+		})
+		return content.String(), err
+	}
+
+	if _, err := archive(&Guard{}, server.URL); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive of a loopback address: %v", err)
+	}
+	if _, err := archive(&Guard{}, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive of a host resolving to a loopback address: %v", err)
+	}
+	if _, err := archive(&Guard{Allow: allow}, server.URL+"/redirect"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive of a redirect to a blocked address: %v", err)
+	}
+
+	content, err := archive(&Guard{Allow: allow}, server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected archive of an allowed address: %v", err)
+	}
+	if !strings.Contains(content, "page") || strings.Contains(content, "secret") {
+		t.Errorf("Unexpected blocked resource archived: %s", content)
+	}
+	if content, err = archive(nil, server.URL); err != nil || !strings.Contains(content, "secret") {
+		t.Errorf("Unexpected archive without guard: %v, %s", err, content)
+	}
+
+	// Through a proxy, only the addresses in the URLs can be checked.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>proxied "+r.URL.Host+"</body></html>")
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	r := &Shaft{Client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, ArchiveOnly: true, Output: t.TempDir(), Guard: &Guard{}}
+	input, _ := url.Parse("http://10.0.0.1/")
+	if _, err := r.Wayback(context.TODO(), input); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive of a blocked address through the proxy: %v", err)
+	}
+	input, _ = url.Parse("http://example.org/")
+	if _, err := r.Wayback(context.TODO(), input); err != nil {
+		t.Errorf("Unexpected archive through the proxy: %v", err)
+	}
+
+	// The proxy is bypassed for loopback addresses, the proxy itself included.
+	client, err := NewClient(proxy.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), Guard: &Guard{}}
+	if _, err := r.Wayback(context.TODO(), input); err != nil {
+		t.Errorf("Unexpected archive through the proxy: %v", err)
+	}
+	input, _ = url.Parse(proxy.URL)
+	if _, err := r.Wayback(context.TODO(), input); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive of the proxy bypassed: %v", err)
+	}
+
+	r = &Shaft{Client: &http.Client{Transport: &helper.RewriteTransport{}}, Guard: &Guard{}, ArchiveOnly: true}
+	if _, err := r.Wayback(context.TODO(), input); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Unexpected archive through a transport that cannot be guarded: %v", err)
+	}
+}
+
+type blockstore map[string][]byte
+
+func (bs blockstore) Block(_ context.Context, c string) ([]byte, error) {
+	if b, ok := bs[c]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("block not found: %s", c)
+}
+
+func (bs blockstore) put(c cid.Cid, b []byte) error {
+	bs[c.String()] = b
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "image.png"), []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeManifest(dir, Manifest{URL: "https://example.com", Captured: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := make(blockstore)
+	root, err := unixfs.AddDir(dir, bs.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := Verify(context.TODO(), bs, root.Cid.String(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected verify: %v", err)
+	}
+	if !v.OK() || v.Manifest == nil || len(v.Manifest.Files) != 2 {
+		t.Fatalf("Unexpected verification: %+v", v)
+	}
+
+	// Compare with the manifest of a source directory that has been changed since.
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = Verify(context.TODO(), bs, root.Cid.String(), m)
+	if err != nil {
+		t.Fatalf("Unexpected verify: %v", err)
+	}
+	if v.OK() || len(v.Mismatches) != 1 || v.Mismatches[0].Path != "index.html" {
+		t.Fatalf("Unexpected verification: %+v", v)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key, err = LoadSigningKey(keyFile); err != nil {
+		t.Fatalf("Unexpected load signing key: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := writeManifest(dir, Manifest{URL: "https://example.com", Captured: time.Now(), Source: SourceFetched})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attest(dir, m, key); err != nil {
+		t.Fatalf("Unexpected attest: %v", err)
+	}
+
+	bs := make(blockstore)
+	root, err := unixfs.AddDir(dir, bs.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, v, err := VerifyAttestation(context.TODO(), bs, root.Cid.String(), pub)
+	if err != nil {
+		t.Fatalf("Unexpected verify attestation: %v", err)
+	}
+	if !v.OK() || a.URL != "https://example.com" || !a.Captured.Equal(m.Captured) || a.Source != SourceFetched {
+		t.Errorf("Unexpected attestation: %+v, verification: %+v", a, v)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, _, err := VerifyAttestation(context.TODO(), bs, root.Cid.String(), other); err == nil {
+		t.Error("Unexpected attestation verified by another key")
+	}
+
+	// The content-id is checked as well when given as CIDv1.
+	v1 := cid.NewCidV1(cid.DagProtobuf, root.Cid.Hash())
+	bs[v1.String()] = bs[root.Cid.String()]
+	if _, _, err := VerifyAttestation(context.TODO(), bs, v1.String(), pub); err != nil {
+		t.Errorf("Unexpected verify attestation of CIDv1: %v", err)
+	}
+
+	// The attestation of an encrypted snapshot is verified once decrypted.
+	id, _ := age.GenerateX25519Identity()
+	enc, err := encrypt(context.TODO(), "", dir, []age.Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(enc)
+	sealed, err := unixfs.AddDir(enc, bs.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyAttestation(context.TODO(), bs, sealed.Cid.String(), pub); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("Unexpected verify attestation of encrypted snapshot: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := Decrypt(context.TODO(), bs, sealed.Cid.String(), []age.Identity{id}, out); err != nil {
+		t.Fatal(err)
+	}
+	if root, err = unixfs.AddDir(out, bs.put); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyAttestation(context.TODO(), bs, root.Cid.String(), pub); err != nil {
+		t.Errorf("Unexpected verify attestation of decrypted snapshot: %v", err)
+	}
+
+	// A file added to the snapshot after the attestation changes its content-id.
+	if err := os.WriteFile(filepath.Join(out, "extra.txt"), []byte("extra"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if root, err = unixfs.AddDir(out, bs.put); err != nil {
+		t.Fatal(err)
+	}
+	v1 = cid.NewCidV1(cid.DagProtobuf, root.Cid.Hash())
+	bs[v1.String()] = bs[root.Cid.String()]
+	if _, _, err := VerifyAttestation(context.TODO(), bs, v1.String(), pub); err == nil || !strings.Contains(err.Error(), "cid") {
+		t.Errorf("Unexpected verify attestation of CIDv1 with another content: %v", err)
+	}
+
+	// The content changed after the attestation.
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if root, err = unixfs.AddDir(dir, bs.put); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, err := VerifyAttestation(context.TODO(), bs, root.Cid.String(), pub); err == nil || v.OK() {
+		t.Errorf("Unexpected attestation of changed snapshot verified: %v", err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"index.html":       content,
+		"assets/image.png": "png",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt(context.TODO(), "", dir, []age.Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatalf("Unexpected encrypt: %v", err)
+	}
+	defer os.RemoveAll(enc)
+
+	bs := make(blockstore)
+	root, err := unixfs.AddDir(enc, bs.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		if bytes.Contains(b, []byte(content)) {
+			t.Fatal("Unexpected plaintext in the pinned blocks")
+		}
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := Decrypt(context.TODO(), bs, root.Cid.String(), []age.Identity{id}, out); err != nil {
+		t.Fatalf("Unexpected decrypt: %v", err)
+	}
+	for name, data := range files {
+		b, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil || string(b) != data {
+			t.Errorf("Unexpected decrypted %s: %q, %v", name, b, err)
+		}
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	if err := Decrypt(context.TODO(), bs, root.Cid.String(), []age.Identity{other}, t.TempDir()); err == nil {
+		t.Error("Unexpected decrypt by another identity")
+	}
+
+	// The encrypted copy counts against the disk budget.
+	work := t.TempDir()
+	s := &Shaft{DiskBudget: 1 << 20}
+	if _, err := encrypt(s.withBudget(context.TODO()), work, dir, []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatalf("Unexpected encrypt: %v", err)
+	}
+	if used := s.diskUsed.Load(); used < int64(len(content)) {
+		t.Errorf("Unexpected disk budget used by the encrypted copy: %d", used)
+	}
+	s = &Shaft{DiskBudget: 256}
+	if _, err := encrypt(s.withBudget(context.TODO()), work, dir, []age.Recipient{id.Recipient()}); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Unexpected encrypt over the disk budget: %v", err)
+	}
+	if entries, _ := os.ReadDir(work); len(entries) != 1 {
+		t.Errorf("Unexpected encrypted directories left: %v", entries)
+	}
+}
+
+const articlePage = `<html>
+<head><title>Site | Home</title><meta property="og:title" content="Rivets explained"><meta name="author" content="Jane Doe"></head>
+<body>
+<nav><a href="/">Home</a> <a href="/about">About</a></nav>
+<div class="sidebar"><p>Subscribe to our newsletter</p></div>
+<article>
+<h1>Rivets explained</h1>
+<p>A rivet is a permanent <strong>mechanical fastener</strong>, see <a href="/wiki/Fastener">fasteners</a>.
+Before being installed, a rivet consists of a smooth cylindrical shaft with a head on one end.</p>
+<img src="data:image/png;base64,iVBORw0KGgo=" alt="inlined">
+<ul><li>Solid rivets</li><li>Blind rivets</li></ul>
+</article>
+<script>track()</script>
+</body>
+</html>`
+
+func TestArticle(t *testing.T) {
+	base, _ := url.Parse("https://example.com/rivets")
+	a, err := readable([]byte(articlePage), base)
+	if err != nil {
+		t.Fatalf("Unexpected readable: %v", err)
+	}
+	if a.title != "Rivets explained" || a.byline != "Jane Doe" {
+		t.Errorf("Unexpected title or byline: %q, %q", a.title, a.byline)
+	}
+
+	md := a.markdown()
+	for _, want := range []string{
+		"# Rivets explained\n\nBy Jane Doe\n\n",
+		"permanent **mechanical fastener**, see [fasteners](https://example.com/wiki/Fastener).",
+		"- Solid rivets\n- Blind rivets",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Unexpected markdown, want %q in:\n%s", want, md)
+		}
+	}
+	for _, unwanted := range []string{"newsletter", "About", "track()", "base64", "# Rivets explained\n\nBy Jane Doe\n\n# "} {
+		if strings.Contains(md, unwanted) {
+			t.Errorf("Unexpected %q in markdown:\n%s", unwanted, md)
+		}
+	}
+
+	text := a.plainText()
+	if !strings.HasPrefix(text, "Rivets explained\nBy Jane Doe\n\nA rivet is a permanent mechanical fastener, see fasteners.") {
+		t.Errorf("Unexpected text:\n%s", text)
+	}
+}
+
+func TestArchiveReadable(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, articlePage)
+	})
+	defer server.Close()
+
+	r := &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: t.TempDir(), Readable: true}
+	input, _ := url.Parse(server.URL)
+	res, err := r.Archive(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	if res.Title != "Rivets explained" || res.Manifest.Title != res.Title {
+		t.Errorf("Unexpected title: %q, manifest title: %q", res.Title, res.Manifest.Title)
+	}
+	if res.Manifest.Source != SourceFetched {
+		t.Errorf("Unexpected source of the webpage fetched: %q", res.Manifest.Source)
+	}
+	if spooled, _ := filepath.Glob(filepath.Join(res.Dest, ".page-*")); len(spooled) != 0 {
+		t.Errorf("Unexpected spool files stored: %v", spooled)
+	}
+	for _, name := range []string{ArticleMarkdown, ArticleText} {
+		b, err := os.ReadFile(filepath.Join(res.Dest, name))
+		if err != nil || !bytes.Contains(b, []byte("mechanical fastener")) {
+			t.Errorf("Unexpected %s: %s, %v", name, b, err)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	x := &Index{Path: filepath.Join(t.TempDir(), "index.jsonl")}
+	if hits, err := x.Search(context.TODO(), "rivet", 0); err != nil || len(hits) != 0 {
+		t.Fatalf("Unexpected search of a missing index: %v, %v", hits, err)
+	}
+
+	now := time.Now().UTC()
+	docs := []struct {
+		doc  Document
+		text string
+	}{
+		{Document{URL: "https://example.com/a", Captured: now, Dest: gateway + "QmA", Title: "Rivets"}, "A rivet is a permanent mechanical fastener. Rivets hold steel plates."},
+		{Document{URL: "https://example.com/b", Captured: now, Dest: "/tmp/b.html", Title: "Bolts"}, "A bolt is a fastener with an external male thread."},
+		{Document{URL: "https://example.com/c", Captured: now, Dest: gateway + "QmC", Title: "铆钉"}, "铆钉是一种永久性的机械紧固件。"},
+	}
+	for _, d := range docs {
+		if err := x.Add(d.doc, d.text); err != nil {
+			t.Fatalf("Unexpected add: %v", err)
+		}
+	}
+
+	hits, err := x.Search(context.TODO(), "Rivet FASTENER", 0)
+	if err != nil {
+		t.Fatalf("Unexpected search: %v", err)
+	}
+	if len(hits) != 2 || hits[0].URL != "https://example.com/a" || hits[1].URL != "https://example.com/b" {
+		t.Fatalf("Unexpected hits: %+v", hits)
+	}
+	if hits[0].CID != "QmA" || len(hits[0].Gateways) != len(gateways) || hits[0].Gateways[0] != gateway+"QmA" {
+		t.Errorf("Unexpected cid or gateways: %+v", hits[0])
+	}
+	if hits[1].CID != "" || hits[1].Gateways != nil || hits[0].Score <= hits[1].Score {
+		t.Errorf("Unexpected second hit: %+v", hits[1])
+	}
+	if !strings.HasPrefix(hits[0].Excerpt, "A rivet is a permanent") {
+		t.Errorf("Unexpected excerpt: %q", hits[0].Excerpt)
+	}
+
+	if hits, err = x.Search(context.TODO(), "紧固", 1); err != nil || len(hits) != 1 || hits[0].Title != "铆钉" {
+		t.Errorf("Unexpected hits of chinese: %+v, %v", hits, err)
+	}
+	if hits, err = x.Search(context.TODO(), "screw", 0); err != nil || len(hits) != 0 {
+		t.Errorf("Unexpected hits of no match: %+v, %v", hits, err)
+	}
+	if _, err = x.Search(context.TODO(), " ,. ", 0); err == nil {
+		t.Error("Unexpected search of an empty query")
+	}
+}
+
+func TestArchiveIndex(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, articlePage)
+	})
+	defer server.Close()
+
+	x := &Index{Path: filepath.Join(t.TempDir(), "index.jsonl")}
+	r := &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), Index: x}
+	input, _ := url.Parse(server.URL)
+	res, err := r.Archive(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	if res.Title != "Rivets explained" {
+		t.Errorf("Unexpected title: %q", res.Title)
+	}
+	if _, err := os.Stat(filepath.Join(res.Dest, ArticleMarkdown)); err == nil {
+		t.Errorf("Unexpected article stored without Readable")
+	}
+
+	hits, err := x.Search(context.TODO(), "blind rivets", 0)
+	if err != nil {
+		t.Fatalf("Unexpected search: %v", err)
+	}
+	if len(hits) != 1 || hits[0].URL != input.String() || hits[0].Dest != res.Dest || !hits[0].Captured.Equal(res.Manifest.Captured) {
+		t.Errorf("Unexpected hits: %+v", hits)
+	}
+	if hits, _ := x.Search(context.TODO(), "newsletter", 0); len(hits) != 0 {
+		t.Errorf("Unexpected hits of the sidebar: %+v", hits)
+	}
+
+	// The encrypted snapshots are not indexed.
+	id, _ := age.GenerateX25519Identity()
+	kubo := ipfstest.NewKubo(nil)
+	defer kubo.Close()
+	x = &Index{Path: filepath.Join(t.TempDir(), "index.jsonl")}
+	r = &Shaft{
+		Client:     client,
+		Hold:       local(kubo),
+		Recipients: []age.Recipient{id.Recipient()},
+		Index:      x,
+	}
+	if _, err := r.Archive(context.TODO(), input); err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	if _, err := os.Stat(x.Path); !os.IsNotExist(err) {
+		t.Errorf("Unexpected index of an encrypted snapshot: %v", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		canonical Canonical
+		input     string
+		want      string
+	}{
+		{Canonical{}, "HTTP://Example.COM:80", "http://example.com/"},
+		{Canonical{}, "https://example.com:443/a?b=2&a=1&a=0#top", "https://example.com/a?a=1&a=0&b=2"},
+		{Canonical{}, "https://example.com:8443/a?utm_source=x&UTM_Medium=y&fbclid=z&id=1", "https://example.com:8443/a?id=1"},
+		{Canonical{}, "https://example.com/a?utm_source=x", "https://example.com/a"},
+		{Canonical{}, "https://example.com/a?q=a%20b&flag", "https://example.com/a?flag&q=a%20b"},
+		{Canonical{HTTPS: true}, "http://example.com:80/a", "https://example.com/a"},
+		{Canonical{Strip: []string{"ref"}}, "https://example.com/?ref=x&utm_source=y", "https://example.com/?utm_source=y"},
+		{Canonical{Strip: append(TrackingParams, "session*")}, "https://example.com/?sessionid=1&utm_source=y&p=2", "https://example.com/?p=2"},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.input)
+		if got := test.canonical.URL(u).String(); got != test.want {
+			t.Errorf("Unexpected canonical URL of %s: %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestArchiveCanonical(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><link rel="canonical" href="/story?page=1&utm_campaign=feed"></head><body>story</body></html>`)
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><link rel="canonical" href="https://attacker.example/"></head><body>story</body></html>`)
+	})
+	defer server.Close()
+
+	tests := []struct {
+		canonical *Canonical
+		input     string
+		url       string
+		original  string
+	}{
+		{nil, "/story?utm_source=x#top", "/story?utm_source=x#top", ""},
+		{&Canonical{}, "/story?utm_source=x#top", "/story", "/story?utm_source=x#top"},
+		{&Canonical{}, "/story", "/story", ""},
+		{&Canonical{Link: true}, "/amp/story?utm_source=x", "/story?page=1", "/amp/story?utm_source=x"},
+		{&Canonical{Link: true}, "/elsewhere", "/elsewhere", ""},
+	}
+	for _, test := range tests {
+		r := &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: t.TempDir(), Canonical: test.canonical}
+		input, _ := url.Parse(server.URL + test.input)
+		res, err := r.Archive(context.TODO(), input)
+		if err != nil {
+			t.Fatalf("Unexpected archive: %v", err)
+		}
+		m, err := ReadManifest(filepath.Join(res.Dest, ManifestFile))
+		if err != nil {
+			t.Fatalf("Unexpected read manifest: %v", err)
+		}
+
+		want := server.URL + test.url
+		if m.URL != want || res.URL != want {
+			t.Errorf("Unexpected url of %s: %s, result: %s, want %s", test.input, m.URL, res.URL, want)
+		}
+		if want = test.original; want != "" {
+			want = server.URL + want
+		}
+		if m.Original != want {
+			t.Errorf("Unexpected original url of %s: %q, want %q", test.input, m.Original, want)
+		}
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	pages := map[string]string{
+		"/":            `<html><body><a href="/docs/a">A</a> <a href="/b#top">B</a> <a href="https://example.org/">Ext</a></body></html>`,
+		"/docs/a":      strings.Replace(articlePage, "<nav>", `<nav><a href="/docs/a/deep">Deep</a>`, 1),
+		"/b":           `<html><body><a href="/docs/a">A</a></body></html>`,
+		"/docs/a/deep": `<html><body>deep</body></html>`,
+	}
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(page))
+	})
+	defer server.Close()
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) // nolint:errcheck
+
+	seed, _ := url.Parse(server.URL)
+	r := &Shaft{Client: client, ArchiveOnly: true, Readable: true}
+	dir, err := r.Crawl(context.TODO(), seed, Crawl{Depth: 1})
+	if err != nil {
+		t.Fatalf("Unexpected crawl: %v", err)
+	}
+
+	for _, name := range []string{"index.html", "index/index.html", "docs-a/index.html", "b/index.html"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Unexpected missing page: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs-a-deep")); err == nil {
+		t.Error("Unexpected page beyond depth archived")
+	}
+	for _, name := range []string{ArticleMarkdown, ArticleText} {
+		b, err := os.ReadFile(filepath.Join(dir, "docs-a", name))
+		if err != nil || !bytes.Contains(b, []byte("mechanical fastener")) {
+			t.Errorf("Unexpected %s of the page: %s, %v", name, b, err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "index", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, href := range []string{`href="../docs-a/index.html"`, `href="../b/index.html"`, `href="https://example.org/"`} {
+		if !strings.Contains(string(b), href) {
+			t.Errorf("Unexpected links of seed page, %s not found in %s", href, b)
+		}
+	}
+
+	// The scope is of the host the seed redirects to.
+	mux.HandleFunc("example.com/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://www.example.com/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("www.example.com/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/docs/b", http.StatusFound)
+			return
+		case "/away":
+			http.Redirect(w, r, "http://elsewhere.example/", http.StatusFound)
+			return
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/docs/a">A</a> <a href="/moved">Moved</a> <a href="/away">Away</a> `+
+			`<a href="/slow">Slow</a> <a href="http://example.com/">Home</a></body></html>`)
+	})
+	seed, _ = url.Parse("http://example.com/")
+	if dir, err = r.Crawl(context.TODO(), seed, Crawl{Depth: 1, Timeout: time.Second}); err != nil {
+		t.Fatalf("Unexpected crawl of the redirected seed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// The page timing out and the one redirecting out of the scope are skipped.
+	if strings.Join(names, " ") != "docs-a index index.html manifest.json moved" {
+		t.Errorf("Unexpected pages of the redirected seed: %v", names)
+	}
+	// The links to the URL requested and to the one redirected to are rewritten.
+	b, err = os.ReadFile(filepath.Join(dir, "index", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, href := range []string{`href="../moved/index.html"`, `href="../index/index.html"`} {
+		if !strings.Contains(string(b), href) {
+			t.Errorf("Unexpected links of the redirected seed, %s not found in %s", href, b)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/old</loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc>https://example.com/new</loc><lastmod>2023-05-01T10:00:00+00:00</lastmod></url>
+  <url><loc>https://example.com/undated</loc></url>
+</urlset>`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(sitemap))
+	zw.Close()
+
+	responses := map[string]string{
+		"/sitemap.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>/sitemap-1.xml.gz</loc><lastmod>2024-01-01</lastmod></sitemap>
+  <sitemap><loc>/sitemap-2.xml</loc><lastmod>2019-01-01</lastmod></sitemap>
+</sitemapindex>`,
+		"/sitemap-1.xml.gz": gz.String(),
+		"/rss.xml": `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>News</title><link>https://example.com/</link>
+  <item><link>https://example.com/a</link><pubDate>Mon, 01 May 2023 10:00:00 +0000</pubDate></item>
+  <item><link>https://example.com/b</link><pubDate>Sun, 01 Jan 2023 10:00:00 +0000</pubDate></item>
+</channel></rss>`,
+		"/atom.xml": `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>News</title>
+  <entry><link rel="self" href="https://example.com/a.atom"/><link href="https://example.com/a"/><updated>2023-05-01T10:00:00Z</updated></entry>
+</feed>`,
+	}
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sitemap-2.xml" {
+			t.Error("Unexpected fetch of sitemap out of range")
+		}
+		_, _ = w.Write([]byte(responses[r.URL.Path]))
+	})
+	defer server.Close()
+
+	// The sitemap modified after until still lists entries in the range.
+	since, until := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/sitemap.xml", []string{"https://example.com/new", "https://example.com/undated"}},
+		{"/rss.xml", []string{"https://example.com/a"}},
+		{"/atom.xml", []string{"https://example.com/a"}},
+	}
+	r := &Shaft{Client: client}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			source, _ := url.Parse(server.URL + test.path)
+			urls, err := r.Expand(context.TODO(), source, since, until)
+			if err != nil {
+				t.Fatalf("Unexpected expand: %v", err)
+			}
+			got := make([]string, len(urls))
+			for i, u := range urls {
+				got[i] = u.String()
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Fatalf("Unexpected urls got %v instead of %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	now := time.Date(2023, 5, 2, 10, 7, 30, 0, time.UTC) // Tuesday
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2023, 5, 2, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, 5, 2, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.Date(2023, 5, 2, 11, 0, 0, 0, time.UTC)},
+		{"30 6 * * sat,7", time.Date(2023, 5, 6, 6, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * mon", time.Date(2023, 5, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2023, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", now.Add(90 * time.Minute)},
+		{"0 0 30 feb *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("Unexpected parse %q: %v", test.spec, err)
+		}
+		if next := s.Next(now); !next.Equal(test.next) {
+			t.Errorf("Unexpected next of %q got %s instead of %s", test.spec, next, test.next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "@every -1s"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("Unexpected parse %q without error", spec)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var (
+		pins int
+		page = content
+	)
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Hostname() == "api.pinata.cloud":
+			pins++
+			handleResponse(w, r)
+		case r.URL.Path == "/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(page))
+		default:
+			handleResponse(w, r)
+		}
+	})
+	defer server.Close()
+
+	opts := []ipfs.PinningOption{
+		ipfs.Mode(ipfs.Remote),
+		ipfs.Uses(pinner.Pinata),
+		ipfs.Apikey(apikey),
+		ipfs.Secret(secret),
+		ipfs.Client(client),
+	}
+	w := &Watch{
+		Shaft:    &Shaft{Hold: ipfs.Options(opts...), Client: client},
+		Schedule: Every(time.Millisecond),
+		State:    filepath.Join(t.TempDir(), "state.json"),
+	}
+	input, _ := url.Parse(server.URL)
+
+	var captures []Capture
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := w.Run(ctx, []*url.URL{input}, func(c Capture) {
+		captures = append(captures, c)
+		switch len(captures) {
+		case 2:
+			page = strings.Replace(content, "Example Domain", "Changed Domain", 1)
+		case 3:
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("Unexpected run: %v", err)
+	}
+
+	changed := []bool{true, false, true}
+	for i, c := range captures {
+		if c.Err != nil {
+			t.Fatalf("Unexpected capture: %v", c.Err)
+		}
+		if c.Changed != changed[i] {
+			t.Errorf("Unexpected change of capture %d got %t instead of %t", i, c.Changed, changed[i])
+		}
+	}
+	if pins != 2 {
+		t.Errorf("Unexpected pinned %d times instead of twice", pins)
+	}
+
+	state, err := w.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state[input.String()].Digest != captures[2].Digest {
+		t.Errorf("Unexpected digest in state: %+v", state)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	rb := parseRobots(strings.NewReader(`# robots.txt
+User-agent: Googlebot
+Disallow: /
+
+User-agent: rivet
+User-Agent: other
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow:
+
+User-agent: *
+Disallow: /tmp/
+`))
+
+	tests := []struct {
+		agent, path string
+		allowed     bool
+	}{
+		{"rivet", "/", true},
+		{"rivet", "/private", false},
+		{"rivet", "/private/page?q=1", false},
+		{"rivet", "/private/public/page", true},
+		{"rivet", "/docs/a.pdf", false},
+		{"rivet", "/docs/a.pdf?download", true},
+		{"rivet", "/tmp/a", true},
+		{"Rivet", "/private", false},
+		{"googlebot", "/docs", false},
+		{"unknown", "/tmp/a", false},
+		{"unknown", "/private", true},
+	}
+	for _, test := range tests {
+		if ok, _ := rb.allowed(test.agent, test.path); ok != test.allowed {
+			t.Errorf("Unexpected allowed %q for %s, got %t instead of %t", test.path, test.agent, ok, test.allowed)
+		}
+	}
+}
+
+func TestPoliteness(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inflight int
+		peak     int
+	)
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/private" {
+			mu.Lock()
+			inflight++
+			if inflight > peak {
+				peak = inflight
+			}
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+			w.Header().Set("Content-Type", "text/css")
+			_, _ = w.Write([]byte("body{}"))
+			return
+		}
+		var page strings.Builder
+		page.WriteString("<html><head>")
+		for i := 0; i < 8; i++ {
+			fmt.Fprintf(&page, `<link rel="stylesheet" href="/style-%d.css">`, i)
+		}
+		page.WriteString("</head><body>polite</body></html>")
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(page.String()))
+	})
+	defer server.Close()
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) // nolint:errcheck
+
+	r := &Shaft{Client: client, ArchiveOnly: true, HostConcurrency: 2, Robots: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input, _ := url.Parse(server.URL)
+			if _, err := r.Wayback(context.TODO(), input); err != nil {
+				t.Errorf("Unexpected wayback: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak == 0 || peak > 2 {
+		t.Errorf("Unexpected concurrent requests to the host, got %d instead of at most 2", peak)
+	}
+
+	input, _ := url.Parse(server.URL + "/private")
+	if _, err := r.Wayback(context.TODO(), input); !errors.Is(err, ErrDisallowed) {
+		t.Fatalf("Unexpected wayback of disallowed page: %v", err)
+	}
+}
+
+func TestMaxCaptureSize(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><img src="/large.png"></body></html>`)
+	})
+	mux.HandleFunc("/streamed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><img src="/streamed.png"></body></html>`)
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "65536")
+		w.Write(make([]byte, 65536))
+	})
+	mux.HandleFunc("/streamed.png", func(w http.ResponseWriter, r *http.Request) {
+		// Without Content-Length, the size is only known once read.
+		w.Header().Set("Content-Type", "image/png")
+		for i := 0; i < 16; i++ {
+			w.Write(make([]byte, 4096))
+			w.(http.Flusher).Flush()
+		}
+	})
+	defer server.Close()
+
+	for _, path := range []string{"/", "/streamed"} {
+		input, _ := url.Parse(server.URL + path)
+		r := &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: t.TempDir(), MaxCaptureSize: 32 * 1024}
+		if _, err := r.Archive(context.TODO(), input); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("Unexpected archive of %s over the size: %v", path, err)
+		}
+	}
+
+	input, _ := url.Parse(server.URL)
+	r := &Shaft{Client: client, ArchiveOnly: true, KeepDir: true, Output: t.TempDir(), MaxCaptureSize: 1 << 20}
+	res, err := r.Archive(context.TODO(), input)
+	if err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	entries, _ := os.ReadDir(res.Dest)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("Unexpected hidden file in snapshot: %s", e.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(res.Dest, "index.html")); err != nil {
+		t.Errorf("Unexpected index file: %v", err)
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	client, mux, server := helper.MockServer()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><img src="/large.png"></body></html>`)
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 65536))
+	})
+	mux.HandleFunc("/site", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/">Large</a></body></html>`)
+	})
+	defer server.Close()
+
+	input, _ := url.Parse(server.URL)
+	work := filepath.Join(t.TempDir(), "work")
+	entries := func() []os.DirEntry {
+		entries, _ := os.ReadDir(work)
+		return entries
+	}
+
+	r := &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), WorkDir: work, MinFreeSpace: 1 << 62}
+	if _, err := r.Archive(context.TODO(), input); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Unexpected archive without free space: %v", err)
+	}
+
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), WorkDir: work, MinFreeSpace: 1, DiskBudget: 32 * 1024}
+	if _, err := r.Archive(context.TODO(), input); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Unexpected archive over the disk budget: %v", err)
+	}
+	if used := r.diskUsed.Load(); used != 0 {
+		t.Errorf("Unexpected disk budget used after the capture: %d", used)
+	}
+	if e := entries(); len(e) != 0 {
+		t.Errorf("Unexpected temp directories left: %v", e)
+	}
+	r.diskUsed.Store(r.DiskBudget)
+	if _, err := r.Archive(context.TODO(), input); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Unexpected archive with the disk budget used up: %v", err)
+	}
+
+	// The crawl fails too once a page exceeds it, rather than storing the pages before.
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), WorkDir: work, DiskBudget: 32 * 1024}
+	seed, _ := url.Parse(server.URL + "/site")
+	if _, err := r.Crawl(context.TODO(), seed, Crawl{Depth: 1}); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Unexpected crawl over the disk budget: %v", err)
+	}
+	if used := r.diskUsed.Load(); used != 0 {
+		t.Errorf("Unexpected disk budget used after the crawl: %d", used)
+	}
+
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), WorkDir: work, MaxCaptureSize: 1024, KeepFailed: true}
+	if _, err := r.Archive(context.TODO(), input); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Unexpected archive over the size: %v", err)
+	}
+	if e := entries(); len(e) != 1 || !strings.HasPrefix(e[0].Name(), "rivet-") {
+		t.Errorf("Unexpected temp directories kept: %v", e)
+	}
+
+	r = &Shaft{Client: client, ArchiveOnly: true, Output: t.TempDir(), WorkDir: work, DiskBudget: 1 << 20}
+	if _, err := r.Archive(context.TODO(), input); err != nil {
+		t.Fatalf("Unexpected archive: %v", err)
+	}
+	if used := r.diskUsed.Load(); used != 0 {
+		t.Errorf("Unexpected disk budget used after the capture: %d", used)
+	}
 }
@@ -0,0 +1,135 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// robots is a parsed robots.txt, see RFC 9309.
+type robots struct {
+	groups []robotsGroup
+}
+
+type robotsGroup struct {
+	agents []string
+	rules  []robotsRule
+}
+
+type robotsRule struct {
+	allow bool
+	path  string
+}
+
+// parseRobots parses a robots.txt, lines that are not understood are ignored.
+func parseRobots(r io.Reader) *robots {
+	var (
+		rb    = &robots{}
+		group *robotsGroup
+		rules bool // whether the current group has rules, a user-agent line after them starts a new group
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if group == nil || rules {
+				rb.groups = append(rb.groups, robotsGroup{})
+				group = &rb.groups[len(rb.groups)-1]
+				rules = false
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if group == nil {
+				continue
+			}
+			rules = true
+			// An empty rule matches nothing.
+			if value != "" {
+				group.rules = append(group.rules, robotsRule{allow: key == "allow", path: value})
+			}
+		}
+	}
+	return rb
+}
+
+// allowed reports whether the agent may fetch the path, which includes the query. It returns
+// the rule deciding it, the longest match wins and an allow rule wins a tie.
+func (rb *robots) allowed(agent, path string) (bool, robotsRule) {
+	rules := rb.rules(strings.ToLower(agent))
+	if rules == nil {
+		rules = rb.rules("*")
+	}
+
+	var (
+		matched robotsRule
+		found   bool
+	)
+	for _, r := range rules {
+		if !matchRobots(r.path, path) {
+			continue
+		}
+		if !found || len(r.path) > len(matched.path) || (len(r.path) == len(matched.path) && r.allow) {
+			matched, found = r, true
+		}
+	}
+	return !found || matched.allow, matched
+}
+
+// rules returns the rules of all of the groups of the agent.
+func (rb *robots) rules(agent string) (rules []robotsRule) {
+	for _, g := range rb.groups {
+		for _, a := range g.agents {
+			if a == agent {
+				rules = append(rules, g.rules...)
+				if rules == nil {
+					rules = []robotsRule{}
+				}
+				break
+			}
+		}
+	}
+	return rules
+}
+
+// matchRobots reports whether the path matches the pattern of a rule, which
+// is a path prefix that may contain the * wildcard and end with the $ anchor.
+func matchRobots(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !anchored || path == ""
+	}
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 && anchored {
+			return strings.HasSuffix(path, part)
+		}
+		j := strings.Index(path, part)
+		if j < 0 {
+			return false
+		}
+		path = path[j+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultRequestTimeout is the timeout of requesting every resource if no rule sets it.
+const defaultRequestTimeout = 3 * time.Second
+
+// Rule customizes the capture of the webpages it matches, a rule
+// matches any URL if neither Host nor Match is set.
+type Rule struct {
+	// Host matches the URLs of the host and its subdomains, e.g. example.com.
+	Host string
+
+	// Match matches the URLs by regular expression.
+	Match *regexp.Regexp
+
+	DisableJS     bool
+	DisableCSS    bool
+	DisableEmbeds bool
+	DisableMedias bool
+
+	// Timeout is the timeout of requesting every resource, defaults to 3 seconds.
+	Timeout time.Duration
+
+	// UserAgent is the user agent of the requests, defaults to the one of Shaft.
+	UserAgent string
+
+	// MaxSize is the maximum size in bytes of the webpage and every resource,
+	// resources larger than it are skipped. Zero means no limit.
+	MaxSize int64
+}
+
+// UnmarshalJSON decodes the rule from a JSON object, such as:
+//
+//	{"host": "example.com", "match": "^https://example\\.com/docs/", "disable_js": true,
+//	 "disable_css": true, "disable_embeds": true, "disable_medias": true,
+//	 "timeout": "10s", "user_agent": "Mozilla/5.0", "max_size": 10485760}
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Host          string `json:"host"`
+		Match         string `json:"match"`
+		DisableJS     bool   `json:"disable_js"`
+		DisableCSS    bool   `json:"disable_css"`
+		DisableEmbeds bool   `json:"disable_embeds"`
+		DisableMedias bool   `json:"disable_medias"`
+		Timeout       string `json:"timeout"`
+		UserAgent     string `json:"user_agent"`
+		MaxSize       int64  `json:"max_size"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*r = Rule{
+		Host:          v.Host,
+		DisableJS:     v.DisableJS,
+		DisableCSS:    v.DisableCSS,
+		DisableEmbeds: v.DisableEmbeds,
+		DisableMedias: v.DisableMedias,
+		UserAgent:     v.UserAgent,
+		MaxSize:       v.MaxSize,
+	}
+	if v.Match != "" {
+		re, err := regexp.Compile(v.Match)
+		if err != nil {
+			return errors.Wrap(err, "invalid match of rule")
+		}
+		r.Match = re
+	}
+	if v.Timeout != "" {
+		d, err := time.ParseDuration(v.Timeout)
+		if err != nil {
+			return errors.Wrap(err, "invalid timeout of rule")
+		}
+		r.Timeout = d
+	}
+	return nil
+}
+
+// LoadRules reads the rules from a JSON file holding an array of rules, see Rule.UnmarshalJSON.
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, errors.Wrap(err, "parse rules failed")
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to the URL.
+func (r *Rule) matches(u *url.URL) bool {
+	if r.Host != "" {
+		host, want := strings.ToLower(u.Hostname()), strings.ToLower(r.Host)
+		if host != want && !strings.HasSuffix(host, "."+want) {
+			return false
+		}
+	}
+	if r.Match != nil && !r.Match.MatchString(u.String()) {
+		return false
+	}
+	return true
+}
+
+// rule returns the first of the rules matching the URL, or the zero rule if none matches.
+func (s *Shaft) rule(uri string) Rule {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Rule{}
+	}
+	for _, r := range s.Rules {
+		if r.matches(u) {
+			return r
+		}
+	}
+	return Rule{}
+}
+
+// limitTransport skips the responses larger than max bytes.
+type limitTransport struct {
+	base http.RoundTripper
+	max  int64
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.max {
+		resp.Body.Close()
+		return nil, errors.Errorf("resource too large: %s (%d bytes)", req.URL, resp.ContentLength)
+	}
+	if resp.ContentLength >= 0 {
+		return resp, nil
+	}
+
+	// The size is unknown, reads the body ahead since an error
+	// reading it would fail the whole capture.
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.max+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > t.max {
+		return nil, errors.Errorf("resource too large: %s", req.URL)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	return resp, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// client returns the http client for capturing webpages, which complies with
+// the limits of requests to each host and the Guard. The user agent and cookie jar are
+// applied by its transport, since obelisk only takes the transport. The extra headers
+// are applied by archive, to the host of the webpage only.
+func (s *Shaft) client() *http.Client {
+	c := &http.Client{}
+	if s.Client != nil {
+		*c = *s.Client
+	}
+	c.Transport = &politeTransport{base: s.guarded(), polite: s.politeness()}
+	if s.UserAgent != "" {
+		c.Transport = &headerTransport{base: c.Transport, agent: s.UserAgent}
+	}
+
+	jar := s.Jar
+	if jar == nil {
+		jar = c.Jar
+	}
+	if jar != nil {
+		c.Transport = &jarTransport{base: c.Transport, jar: jar}
+		c.Jar = nil
+	}
+	return c
+}
+
+// headerTransport applies the user agent to the requests, and the extra headers to
+// the requests to host only. The headers, which may hold credentials, are neither
+// sent to the third-party resources nor to the hosts redirected to.
+type headerTransport struct {
+	base   http.RoundTripper
+	agent  string
+	header http.Header
+	host   string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request must not be modified, see http.RoundTripper.
+	req = req.Clone(req.Context())
+	// A user agent set by obelisk follows the rules.
+	if t.agent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.agent)
+	}
+	if strings.EqualFold(req.URL.Host, t.host) {
+		for k, v := range t.header {
+			req.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// NewClient returns a http client that sends the requests through the proxy and trusts
+// the certificate authorities in the PEM file cacert besides the system ones. The proxy
+// is a URL with the scheme http, https or socks5, e.g. socks5://127.0.0.1:9050 for Tor,
+// and defaults to the one given by the environment variables. Requests to loopback
+// addresses, such as a local IPFS node, never go through the proxy.
+func NewClient(proxy, cacert string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy")
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		case "socks5h":
+			// The socks5 proxy resolves host names too.
+			u.Scheme = "socks5"
+		default:
+			return nil, errors.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if isLoopback(req.URL.Hostname()) {
+				return nil, nil
+			}
+			return u, nil
+		}
+	}
+
+	if cacert != "" {
+		pem, err := os.ReadFile(cacert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", cacert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/wabarc/rivet/ipfs"
+)
+
+// Mismatch describes a file of a snapshot that differs from its manifest.
+type Mismatch struct {
+	Path string
+
+	// Want is the digest recorded in the manifest, it is empty
+	// if the file is not listed in the manifest.
+	Want string
+	// Got is the digest of the file found in IPFS, it is empty if the
+	// file is absent or some of its blocks are missing or corrupt.
+	Got string
+}
+
+func (m Mismatch) String() string {
+	switch {
+	case m.Want == "":
+		return fmt.Sprintf("%s: not in manifest", m.Path)
+	case m.Got == "":
+		return fmt.Sprintf("%s: missing or incomplete", m.Path)
+	default:
+		return fmt.Sprintf("%s: sha256 %s, want %s", m.Path, m.Got, m.Want)
+	}
+}
+
+// Verification is the outcome of verifying a snapshot.
+type Verification struct {
+	*ipfs.Report
+
+	// Manifest is the manifest the snapshot has been compared with, if any.
+	Manifest   *Manifest
+	Mismatches []Mismatch
+}
+
+// OK reports whether the snapshot is complete and matches its manifest.
+func (v *Verification) OK() bool {
+	return v.Report.OK() && len(v.Mismatches) == 0
+}
+
+// Verify fetches the snapshot with the given content-id through f, verifying each block
+// and recomputing the digest of each file. The files are compared with the manifest m,
+// or with the manifest stored in the snapshot if m is nil.
+func Verify(ctx context.Context, f ipfs.Fetcher, cid string, m *Manifest) (*Verification, error) {
+	report, err := ipfs.Inspect(ctx, f, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{Report: report, Manifest: m}
+	if v.Manifest == nil {
+		if v.Manifest, err = storedManifest(ctx, f, report); err != nil {
+			return nil, err
+		}
+	}
+	if v.Manifest == nil {
+		return v, nil
+	}
+
+	found := make(map[string]ipfs.Entry, len(report.Files))
+	for _, e := range report.Files {
+		found[e.Path] = e
+	}
+	listed := make(map[string]bool, len(v.Manifest.Files))
+	for _, file := range v.Manifest.Files {
+		listed[file.Path] = true
+		if e := found[file.Path]; e.SHA256 != file.SHA256 {
+			v.Mismatches = append(v.Mismatches, Mismatch{Path: file.Path, Want: file.SHA256, Got: e.SHA256})
+		}
+	}
+	for _, e := range report.Files {
+		if !listed[e.Path] && !unlisted(e.Path) {
+			v.Mismatches = append(v.Mismatches, Mismatch{Path: e.Path, Got: e.SHA256})
+		}
+	}
+
+	return v, nil
+}
+
+// storedManifest reads the manifest of the snapshot from IPFS, it returns
+// nil if the snapshot has no manifest or it cannot be fetched.
+func storedManifest(ctx context.Context, f ipfs.Fetcher, report *ipfs.Report) (*Manifest, error) {
+	for _, e := range report.Files {
+		if e.Path != ManifestFile || e.SHA256 == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := ipfs.Cat(ctx, f, e.CID, &buf); err != nil {
+			return nil, err
+		}
+		return parseManifest(buf.Bytes())
+	}
+	return nil, nil
+}
+
+// unlisted reports whether the file of the given path is
+// part of a snapshot without being listed in the manifest.
+func unlisted(path string) bool {
+	return path == ManifestFile || path == AttestationFile
+}
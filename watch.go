@@ -0,0 +1,173 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Watch re-archives webpages on a schedule. A snapshot is only stored if the
+// content of the webpage changed since the last stored snapshot.
+type Watch struct {
+	// Shaft archives and stores the webpages.
+	Shaft *Shaft
+
+	// Schedule tells when to re-archive the webpages.
+	Schedule Schedule
+
+	// Timeout limits the time of archiving every webpage, zero means no limit.
+	Timeout time.Duration
+
+	// State is the file in which the last snapshot of each webpage is recorded,
+	// so that changes are detected across restarts. If empty, it is kept in memory.
+	State string
+}
+
+// Capture is the outcome of re-archiving a webpage.
+type Capture struct {
+	URL  string    `json:"url"`
+	Time time.Time `json:"time"`
+
+	// Digest identifies the content of the last stored snapshot, see Manifest.Digest.
+	Digest string `json:"digest"`
+	// Dest is the destination of the last stored snapshot.
+	Dest string `json:"dest"`
+
+	// Changed reports whether a new snapshot has been stored.
+	Changed bool  `json:"-"`
+	Err     error `json:"-"`
+}
+
+// Run archives the webpages right away and then on the schedule, until ctx is done.
+// The outcome of every webpage is passed to report, which may be nil.
+func (w *Watch) Run(ctx context.Context, inputs []*url.URL, report func(Capture)) error {
+	if w.Shaft == nil || w.Schedule == nil {
+		return errors.New("watch requires a shaft and a schedule")
+	}
+
+	state, err := w.load()
+	if err != nil {
+		return err
+	}
+
+	for {
+		for _, input := range inputs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			c := w.recapture(ctx, input, state[input.String()])
+			if c.Err == nil {
+				state[c.URL] = c
+			}
+			if report != nil {
+				report(c)
+			}
+		}
+		if err := w.save(state); err != nil {
+			return err
+		}
+
+		next := w.Schedule.Next(time.Now())
+		if next.IsZero() {
+			return nil
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// recapture archives the webpage and stores the snapshot if its digest differs from the last one.
+func (w *Watch) recapture(ctx context.Context, input *url.URL, last Capture) Capture {
+	c := Capture{URL: input.String(), Time: time.Now(), Digest: last.Digest, Dest: last.Dest}
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	ctx = w.Shaft.begin(ctx, input)
+	defer func() { track(ctx).finish(c.Err) }()
+	snap, err := w.Shaft.capture(ctx, input, nil)
+	if err != nil {
+		w.Shaft.notify(ctx, input, "", "", err)
+		c.Err = err
+		return c
+	}
+	defer func() { w.Shaft.discard(ctx, snap.dir, snap.budget, c.Err) }()
+
+	digest := snap.manifest.Digest()
+	if digest == last.Digest {
+		logger(ctx).Info("unchanged since the last snapshot", "digest", digest)
+		return c
+	}
+
+	dest, err := w.Shaft.store(ctx, snap)
+	w.Shaft.notify(ctx, input, dest, snap.manifest.Title, err)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	c.Digest, c.Dest, c.Changed = digest, dest, true
+	w.Shaft.index(ctx, Document{URL: snap.manifest.URL, Captured: snap.manifest.Captured, Dest: dest, Title: snap.manifest.Title}, snap.text)
+
+	return c
+}
+
+func (w *Watch) load() (map[string]Capture, error) {
+	state := make(map[string]Capture)
+	if w.State == "" {
+		return state, nil
+	}
+
+	b, err := ioutil.ReadFile(w.State)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, errors.Wrap(err, "parse watch state failed")
+	}
+	return state, nil
+}
+
+func (w *Watch) save(state map[string]Capture) error {
+	if w.State == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Writes to a temporary file first, so the state is never left half written.
+	f, err := ioutil.TempFile(filepath.Dir(w.State), filepath.Base(w.State)+".*")
+	if err != nil {
+		return errors.Wrap(err, "save watch state failed")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrap(err, "save watch state failed")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "save watch state failed")
+	}
+	return os.Rename(f.Name(), w.State)
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureHeader is the header of the signature of the notifications, in
+	// the form of sha256=<hex>, see Webhook.Secret.
+	SignatureHeader = "X-Rivet-Signature"
+
+	// EventHeader is the header of the event of the notifications.
+	EventHeader = "X-Rivet-Event"
+
+	webhookTimeout        = 10 * time.Second
+	webhookMaxElapsedTime = time.Minute
+	webhookMaxRetries     = 5
+)
+
+// The events of the notifications.
+const (
+	EventArchived = "archived"
+	EventFailed   = "failed"
+)
+
+// gateway is the IPFS gateway of the destinations of the pinned snapshots.
+const gateway = "https://ipfs.io/ipfs/"
+
+// gateways are the IPFS gateways linked by the notifications and search results.
+var gateways = []string{gateway, "https://dweb.link/ipfs/", "https://cloudflare-ipfs.com/ipfs/"}
+
+// gatewayLinks returns the links to the content of the given content-id on the gateways.
+func gatewayLinks(cid string) []string {
+	links := make([]string, 0, len(gateways))
+	for _, g := range gateways {
+		links = append(links, g+cid)
+	}
+	return links
+}
+
+// Webhook is a target notified once archiving a webpage completes, either way.
+type Webhook struct {
+	// URL receives the notifications as JSON POST requests, see Notification.
+	URL string
+
+	// Secret signs the notifications if set. The signature is the hex-encoded
+	// HMAC-SHA256 of the request body, sent as sha256=<hex> in SignatureHeader.
+	Secret string
+}
+
+// Notification is the body of the requests to the webhooks.
+type Notification struct {
+	Event     string    `json:"event"`
+	URL       string    `json:"url"`
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+
+	// CID and Gateways are set if the snapshot is pinned.
+	CID      string   `json:"cid,omitempty"`
+	Gateways []string `json:"gateways,omitempty"`
+
+	// Dest is the destination of the snapshot, see Shaft.Wayback.
+	Dest string `json:"dest,omitempty"`
+	// Title is the title of the webpage, see Result.Title.
+	Title string `json:"title,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// deadLetter is a line of the dead-letter file.
+type deadLetter struct {
+	Webhook      string       `json:"webhook"`
+	Notification Notification `json:"notification"`
+	Error        string       `json:"error"`
+	Time         time.Time    `json:"time"`
+}
+
+// notify posts the outcome of archiving the webpage of u to the webhooks in the background,
+// retrying with backoff. The notifications that fail to be delivered are appended to DeadLetter.
+func (s *Shaft) notify(ctx context.Context, u *url.URL, dest, title string, err error) {
+	if len(s.Webhooks) == 0 {
+		return
+	}
+
+	n := Notification{
+		Event:     EventArchived,
+		URL:       u.String(),
+		RequestID: RequestID(ctx),
+		Time:      time.Now().UTC(),
+		Dest:      dest,
+		Title:     title,
+	}
+	if err != nil {
+		n.Event, n.Error = EventFailed, err.Error()
+	}
+	if cid := strings.TrimPrefix(dest, gateway); err == nil && cid != dest {
+		n.CID, n.Gateways = cid, gatewayLinks(cid)
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+
+	// The notifications are sent even if archiving timed out, and do not hold it up.
+	ctx = context.WithoutCancel(ctx)
+
+	for _, hook := range s.Webhooks {
+		s.notifying.Add(1)
+		go func(hook Webhook) {
+			defer s.notifying.Done()
+
+			log := logger(ctx).With("webhook", hook.URL)
+			if err := s.deliver(ctx, hook, n.Event, body); err != nil {
+				log.Error("deliver notification failed", "error", err)
+				if s.Metrics != nil {
+					s.Metrics.ObserveError("webhook")
+				}
+				if err := s.bury(hook, n, err); err != nil {
+					log.Error("write dead letter failed", "error", err)
+				}
+				return
+			}
+			log.Info("notification delivered", "event", n.Event)
+		}(hook)
+	}
+}
+
+// Wait waits for the notifications in flight to be delivered or to give up, which
+// takes up to a minute for each of them. It is called before exiting the program.
+func (s *Shaft) Wait() {
+	s.notifying.Wait()
+}
+
+// deliver posts the body to the webhook, retrying on network errors and server errors.
+func (s *Shaft) deliver(ctx context.Context, hook Webhook, event string, body []byte) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	attempts := 0
+	op := func() error {
+		attempts++
+		ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(EventHeader, event)
+		if hook.Secret != "" {
+			req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Warn("deliver notification attempt failed", "webhook", hook.URL, "attempt", attempts, "error", err)
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			err = fmt.Errorf("unexpected status: %s", resp.Status)
+			logger(ctx).Warn("deliver notification attempt failed", "webhook", hook.URL, "attempt", attempts, "error", err)
+			return err
+		default:
+			return backoff.Permanent(fmt.Errorf("unexpected status: %s", resp.Status))
+		}
+	}
+
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = webhookMaxElapsedTime
+	return backoff.Retry(op, backoff.WithMaxRetries(exp, webhookMaxRetries))
+}
+
+// bury appends the notification that failed to be delivered to the dead-letter file.
+func (s *Shaft) bury(hook Webhook, n Notification, cause error) error {
+	if s.DeadLetter == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(deadLetter{Webhook: hook.URL, Notification: n, Error: cause.Error(), Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	s.deadMu.Lock()
+	defer s.deadMu.Unlock()
+
+	f, err := os.OpenFile(s.DeadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open dead-letter file failed")
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write dead-letter file failed")
+	}
+	return f.Close()
+}
+
+// Sign returns the signature of the body of a notification by the secret
+// of the webhook, in the form of sha256=<hex>, see SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
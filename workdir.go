@@ -0,0 +1,67 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rivet
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoSpace is returned when a capture would run out of the disk space of
+// Shaft.WorkDir, see Shaft.MinFreeSpace and Shaft.DiskBudget.
+var ErrNoSpace = errors.New("not enough disk space")
+
+// errFreeSpace is returned by freeSpace on the platforms it is not supported.
+var errFreeSpace = errors.New("free disk space unknown on this platform")
+
+// workDir returns the directory in which the captures are made.
+func (s *Shaft) workDir() string {
+	if s.WorkDir == "" {
+		return os.TempDir()
+	}
+	return s.WorkDir
+}
+
+// admit checks that there is room in the work directory for another capture, that
+// it has MinFreeSpace bytes free and the DiskBudget is not used up.
+func (s *Shaft) admit(ctx context.Context) error {
+	if s.DiskBudget > 0 {
+		if used := s.diskUsed.Load(); used >= s.DiskBudget {
+			return errors.Wrapf(ErrNoSpace, "disk budget of %d bytes used up by the captures in progress", s.DiskBudget)
+		}
+	}
+	if s.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	dir := s.workDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "create work directory failed: "+dir)
+	}
+	free, err := freeSpace(dir)
+	switch {
+	case errors.Is(err, errFreeSpace):
+		logger(ctx).Debug("free disk space not checked", "dir", dir, "error", err)
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "check free disk space failed")
+	case free < s.MinFreeSpace:
+		return errors.Wrapf(ErrNoSpace, "%d bytes free in %s, %d required", free, dir, s.MinFreeSpace)
+	}
+	return nil
+}
+
+// discard removes the temporary directory of a capture, unless it failed with err
+// and KeepFailed is set, and returns the bytes of the capture to the disk budget.
+func (s *Shaft) discard(ctx context.Context, dir string, b *budget, err error) {
+	defer b.release()
+	if err != nil && s.KeepFailed {
+		logger(ctx).Warn("temp directory of the failed capture kept", "dir", dir)
+		return
+	}
+	cleanup(ctx, dir)
+}